@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rubenv/sql-migrate"
+)
+
+// A table name, optionally schema qualified, quoted or not
+const tableNamePattern = `((?:"[^"]+"|[\w$]+)(?:\s*\.\s*(?:"[^"]+"|[\w$]+))?)`
+
+// touchedTablePatterns find the table a statement writes to or changes
+var touchedTablePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bCREATE\s+(?:(?:GLOBAL|LOCAL)\s+)?(?:(?:TEMP|TEMPORARY|UNLOGGED)\s+)?TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?` + tableNamePattern),
+	regexp.MustCompile(`(?i)\bALTER\s+TABLE\s+(?:IF\s+EXISTS\s+)?(?:ONLY\s+)?` + tableNamePattern),
+	regexp.MustCompile(`(?i)\bINSERT\s+INTO\s+` + tableNamePattern),
+	regexp.MustCompile(`(?i)\bUPDATE\s+(?:ONLY\s+)?` + tableNamePattern + `\s+(?:(?:AS\s+)?\w+\s+)?SET\b`),
+	regexp.MustCompile(`(?i)\bDELETE\s+FROM\s+(?:ONLY\s+)?` + tableNamePattern),
+	regexp.MustCompile(`(?i)\bMERGE\s+INTO\s+(?:ONLY\s+)?` + tableNamePattern),
+	regexp.MustCompile(`(?i)\bCOPY\s+` + tableNamePattern + `\s*(?:\(|FROM\b)`),
+	regexp.MustCompile(`(?i)\bCREATE\s+(?:UNIQUE\s+)?INDEX\s+(?:CONCURRENTLY\s+)?(?:(?:IF\s+NOT\s+EXISTS\s+)?[\w$"]+\s+)?ON\s+(?:ONLY\s+)?` + tableNamePattern),
+}
+
+// uncertainStatement matches statements whose writes can't be read off the
+// text, anonymous blocks and dynamic SQL
+var uncertainStatement = regexp.MustCompile(`(?i)^\s*DO\b|\bEXECUTE\b|^\s*CALL\b`)
+
+// touchedTables lists the tables the statements write to or change. certain
+// is false when a statement may touch tables the patterns can't see
+func touchedTables(statements []string) (tables []string, certain bool) {
+	seen := map[string]bool{}
+	certain = true
+	for _, stmt := range statements {
+		stmt = sqlComments.ReplaceAllString(stmt, "")
+		if uncertainStatement.MatchString(stmt) {
+			certain = false
+		}
+		for _, pattern := range touchedTablePatterns {
+			for _, match := range pattern.FindAllStringSubmatch(stmt, -1) {
+				name := strings.Join(strings.Fields(match[1]), "")
+				if !seen[name] {
+					seen[name] = true
+					tables = append(tables, name)
+				}
+			}
+		}
+	}
+	sort.Strings(tables)
+	return tables, certain
+}
+
+// analyzeAfterMigrate refreshes the planner statistics after migrations were
+// applied. "all" analyzes the whole database, "touched" only the tables the
+// applied migrations write to, falling back to all when that's uncertain
+// unless fallback is "none"
+func analyzeAfterMigrate(db *sql.DB, source *extensionMigrationSource, appliedIDs []string, mode, fallback string) error {
+	if fallback != "" && fallback != "all" && fallback != "none" {
+		return fmt.Errorf("Invalid POST_MIGRATE_ANALYZE_FALLBACK %q, expected all or none", fallback)
+	}
+	switch mode {
+	case "":
+		return nil
+	case "all":
+		return analyzeAll(db)
+	case "touched":
+	default:
+		return fmt.Errorf("Invalid POST_MIGRATE_ANALYZE %q, expected all or touched", mode)
+	}
+
+	all, err := source.FindMigrations()
+	if err != nil {
+		return err
+	}
+	byID := map[string]*migrate.Migration{}
+	for _, m := range all {
+		byID[m.Id] = m
+	}
+
+	var statements []string
+	certain := true
+	for _, id := range appliedIDs {
+		// Streamed migrations aren't in memory to look at
+		streamed, err := source.overSizeCap(id)
+		if err != nil {
+			return err
+		}
+		if m, ok := byID[id]; ok && !streamed {
+			statements = append(statements, m.Up...)
+		} else {
+			certain = false
+		}
+	}
+	tables, parsed := touchedTables(statements)
+	if !certain || !parsed {
+		if fallback == "none" {
+			logln("Warning, the applied migrations may touch more tables than found, only analyzing those")
+		} else {
+			logln("Could not tell every table the applied migrations touch, analyzing the whole database")
+			return analyzeAll(db)
+		}
+	}
+
+	for _, table := range tables {
+		// Dropped or renamed since, or a false match in a string literal
+		var exists bool
+		if err := db.QueryRow("SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+			return fmt.Errorf("Could not look up table %s: %+v", table, err)
+		}
+		if !exists {
+			continue
+		}
+		if _, err := db.Exec("ANALYZE " + table); err != nil {
+			return fmt.Errorf("Could not analyze %s: %+v", table, err)
+		}
+		logln("Analyzed table: ", table)
+	}
+	return nil
+}
+
+// analyzeAll refreshes the planner statistics of the whole database
+func analyzeAll(db *sql.DB) error {
+	logln("Analyzing the database")
+	if _, err := db.Exec("ANALYZE"); err != nil {
+		return fmt.Errorf("Could not analyze the database: %+v", err)
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rubenv/sql-migrate"
+)
+
+// invalidIndexes lists the schema qualified, quoted names of indexes Postgres
+// marks as invalid, e.g. after a failed CREATE INDEX CONCURRENTLY
+func invalidIndexes(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT n.nspname, c.relname
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE NOT i.indisvalid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	indexes := map[string]bool{}
+	for rows.Next() {
+		var schema, name string
+		if err := rows.Scan(&schema, &name); err != nil {
+			return nil, err
+		}
+		indexes[pq.QuoteIdentifier(schema)+"."+pq.QuoteIdentifier(name)] = true
+	}
+	return indexes, rows.Err()
+}
+
+// checkInvalidIndexes reports indexes that became invalid during the run. They
+// fail the run under FAIL_ON_INVALID_INDEX=true, after being dropped when
+// DROP_INVALID_INDEX=true
+func checkInvalidIndexes(db *sql.DB, before map[string]bool) error {
+	after, err := invalidIndexes(db)
+	if err != nil {
+		return err
+	}
+
+	var created []string
+	for index := range after {
+		if !before[index] {
+			created = append(created, index)
+		}
+	}
+	if len(created) == 0 {
+		return nil
+	}
+	sort.Strings(created)
+	logln("Migrations left invalid indexes behind: ", strings.Join(created, ", "))
+
+	if os.Getenv("FAIL_ON_INVALID_INDEX") != "true" {
+		return nil
+	}
+	if os.Getenv("DROP_INVALID_INDEX") == "true" {
+		for _, index := range created {
+			if _, err := db.Exec("DROP INDEX IF EXISTS " + index); err != nil {
+				return fmt.Errorf("Could not drop invalid index %s: %+v", index, err)
+			}
+			logln("Dropped invalid index: ", index)
+		}
+	}
+	return fmt.Errorf("Migrations left invalid indexes behind: %s", strings.Join(created, ", "))
+}
+
+// parseServerVersion turns "14", "14.2", "9.6", "9.6.24" or a
+// server_version_num like "140002" into the server_version_num form. Before
+// 10 the first two parts make up the major version, 9.6.24 is 90624
+func parseServerVersion(version string) (int, error) {
+	invalid := fmt.Errorf("Invalid server version %q", version)
+	var nums []int
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0, invalid
+		}
+		nums = append(nums, n)
+	}
+	major := nums[0]
+	if len(nums) == 1 && major >= 10000 {
+		return major, nil
+	}
+
+	if major >= 10 {
+		switch len(nums) {
+		case 1:
+			return major * 10000, nil
+		case 2:
+			return major*10000 + nums[1], nil
+		}
+		return 0, invalid
+	}
+	if len(nums) > 3 {
+		return 0, invalid
+	}
+	for len(nums) < 3 {
+		nums = append(nums, 0)
+	}
+	if nums[1] > 99 || nums[2] > 99 {
+		return 0, invalid
+	}
+	return major*10000 + nums[1]*100 + nums[2], nil
+}
+
+// checkTargetDatabase makes sure the connection landed in DB_NAME and reports
+// where the tracking table resolves, so migrations and tracking can't drift apart
+func checkTargetDatabase(db *sql.DB, dbName string) error {
+	var current string
+	var resolved sql.NullString
+	err := db.QueryRow("SELECT current_database(), to_regclass($1)::text", trackingTableName()).Scan(&current, &resolved)
+	if err != nil {
+		return fmt.Errorf("Could not check the target database: %+v", err)
+	}
+	if current != dbName {
+		return fmt.Errorf("Connected to database %q but DB_NAME is %q, check the connection settings for a stray database name", current, dbName)
+	}
+	if resolved.Valid {
+		logf("Tracking table resolves to %s in database %s\n", resolved.String, current)
+	} else {
+		logf("Tracking table %s doesn't exist yet in database %s, it will be created\n", trackingTableLabel(), current)
+	}
+	return nil
+}
+
+// serverVersion is the server_version setting of the target
+func serverVersion(db *sql.DB) (string, error) {
+	var version string
+	if err := db.QueryRow("SELECT current_setting('server_version')").Scan(&version); err != nil {
+		return "", fmt.Errorf("Could not read the server version: %+v", err)
+	}
+	return version, nil
+}
+
+// checkServerVersion refuses servers older than MIN_SERVER_VERSION
+func checkServerVersion(db *sql.DB, minVersion string) error {
+	required, err := parseServerVersion(minVersion)
+	if err != nil {
+		return fmt.Errorf("Invalid MIN_SERVER_VERSION: %+v", err)
+	}
+
+	var versionNum int
+	var version string
+	if err := db.QueryRow("SELECT current_setting('server_version_num')::int, current_setting('server_version')").Scan(&versionNum, &version); err != nil {
+		return fmt.Errorf("Could not read the server version: %+v", err)
+	}
+	if versionNum < required {
+		return fmt.Errorf("Server version %s is older than MIN_SERVER_VERSION %s, the migrations need a newer server. Set SKIP_VERSION_CHECK=true to run anyway", version, minVersion)
+	}
+	return nil
+}
+
+// checkWritable refuses read replicas and read-only sessions before any DDL runs
+func checkWritable(db *sql.DB) error {
+	var inRecovery bool
+	var readOnly string
+	if err := db.QueryRow("SELECT pg_is_in_recovery(), current_setting('transaction_read_only')").Scan(&inRecovery, &readOnly); err != nil {
+		return fmt.Errorf("Could not check whether the target is writable: %+v", err)
+	}
+	if inRecovery {
+		return fmt.Errorf("Target is a read-only replica (pg_is_in_recovery), point the migrator at the primary. Set SKIP_READONLY_CHECK=true to run anyway")
+	}
+	if readOnly == "on" {
+		return fmt.Errorf("Target is read-only (transaction_read_only is on). Set SKIP_READONLY_CHECK=true to run anyway")
+	}
+	return nil
+}
+
+// sqlComments matches block comments and -- comments up to the end of the line
+var sqlComments = regexp.MustCompile(`(?s)/\*.*?\*/|--[^\n]*`)
+
+// isEmptyStatement reports whether a statement is only comments, whitespace and semicolons
+func isEmptyStatement(stmt string) bool {
+	stripped := sqlComments.ReplaceAllString(stmt, "")
+	return len(strings.Trim(stripped, " \t\r\n;")) == 0
+}
+
+// checkEmptyMigrations reports pending migrations whose Up section has no
+// statements, most likely a stub nobody filled in. They fail the run under
+// FAIL_ON_EMPTY_MIGRATION=true
+func checkEmptyMigrations(db *sql.DB, source *extensionMigrationSource, fail bool) error {
+	planned, _, err := migrate.PlanMigration(db, "postgres", source, migrate.Up, 0)
+	if err != nil {
+		return err
+	}
+
+	var empty []string
+	for _, m := range planned {
+		// Streamed migrations are read when applied, and too big to be a stub
+		tooBig, err := source.overSizeCap(m.Id)
+		if err != nil {
+			return err
+		}
+		if tooBig {
+			continue
+		}
+		hasStatement := false
+		for _, stmt := range m.Up {
+			if !isEmptyStatement(stmt) {
+				hasStatement = true
+				break
+			}
+		}
+		if !hasStatement {
+			empty = append(empty, m.Id)
+		}
+	}
+	if len(empty) == 0 {
+		return nil
+	}
+
+	if fail {
+		return fmt.Errorf("Migrations with no Up statements, refusing to record them as applied: %s", strings.Join(empty, ", "))
+	}
+	for _, id := range empty {
+		logln("Warning, migration has no Up statements: ", id)
+	}
+	return nil
+}
+
+// DefaultAppHealthcheckQuery is run for APP_HEALTHCHECK_DSN when no query is set
+const DefaultAppHealthcheckQuery = "SELECT 1"
+
+// checkAppHealth connects with the application's own credentials and runs a
+// representative query, so permission or naming changes show up as the app
+// sees them. The query is bounded by PING_TIMEOUT like the other checks
+func checkAppHealth(dsn, query string) error {
+	if len(strings.TrimSpace(query)) == 0 {
+		query = DefaultAppHealthcheckQuery
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return fmt.Errorf("App healthcheck could not open APP_HEALTHCHECK_DSN: %+v", err)
+	}
+	defer db.Close()
+
+	err = withPingTimeout(func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return fmt.Errorf("App healthcheck query failed after migrating: %+v", err)
+	}
+	logln("App healthcheck passed")
+	return nil
+}
+
+// DefaultBlockerMinDuration is how long a session must have been running to be reported as a blocker
+const DefaultBlockerMinDuration = 30 * time.Second
+
+// handleLockBlockers reports sessions holding relation locks, which all
+// conflict with ACCESS EXCLUSIVE, for longer than minDuration. They are only
+// terminated when confirmed and the database is on the allowlist
+func handleLockBlockers(db *sql.DB, dbName string, minDuration time.Duration, terminate bool) error {
+	rows, err := db.Query(`SELECT a.pid, COALESCE(a.usename, ''), COALESCE(a.state, ''),
+			EXTRACT(EPOCH FROM now() - COALESCE(a.xact_start, a.query_start))::bigint,
+			left(COALESCE(a.query, ''), 200), string_agg(DISTINCT l.mode, ', ')
+		FROM pg_stat_activity a
+		JOIN pg_locks l ON l.pid = a.pid
+		WHERE a.datname = current_database()
+			AND a.pid <> pg_backend_pid()
+			AND l.locktype = 'relation'
+			AND l.granted
+			AND now() - COALESCE(a.xact_start, a.query_start) > make_interval(secs => $1)
+		GROUP BY a.pid, a.usename, a.state, a.xact_start, a.query_start, a.query`, minDuration.Seconds())
+	if err != nil {
+		return fmt.Errorf("Could not look up blocking sessions: %+v", err)
+	}
+	defer rows.Close()
+
+	var pids []int
+	for rows.Next() {
+		var pid int
+		var seconds int64
+		var user, state, query, modes string
+		if err := rows.Scan(&pid, &user, &state, &seconds, &query, &modes); err != nil {
+			return err
+		}
+		logf("Blocking session pid %d (user %s, %s for %ds) holds %s: %s\n", pid, user, state, seconds, modes, query)
+		pids = append(pids, pid)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if len(pids) == 0 {
+		logln("No long running sessions holding locks")
+		return nil
+	}
+	if !terminate {
+		logf("Reported %d blocking sessions, not terminating them\n", len(pids))
+		return nil
+	}
+
+	allowed := false
+	for _, name := range parseList(os.Getenv("TERMINATE_BLOCKERS_ALLOWLIST")) {
+		allowed = allowed || name == dbName
+	}
+	if !allowed {
+		return fmt.Errorf("Refusing to terminate sessions on %q, it isn't in TERMINATE_BLOCKERS_ALLOWLIST", dbName)
+	}
+	for _, pid := range pids {
+		var terminated bool
+		if err := db.QueryRow("SELECT pg_terminate_backend($1)", pid).Scan(&terminated); err != nil {
+			return fmt.Errorf("Could not terminate pid %d: %+v", pid, err)
+		}
+		logf("Terminated blocking session pid %d: %t\n", pid, terminated)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestParseServerVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		want    int
+	}{
+		{"14", 140000},
+		{"14.2", 140002},
+		{"10.23", 100023},
+		{"140002", 140002},
+		{"90600", 90600},
+		{"9.6", 90600},
+		{"9.6.24", 90624},
+		{"9.4.26", 90426},
+		{"9", 90000},
+	} {
+		got, err := parseServerVersion(tc.version)
+		if err != nil || got != tc.want {
+			t.Errorf("parseServerVersion(%q) = %d, %v, want %d", tc.version, got, err, tc.want)
+		}
+	}
+
+	for _, version := range []string{"", "abc", "14.x", "-1", "14.2.1", "9.6.1.2", "9.100", "9.6.100"} {
+		if got, err := parseServerVersion(version); err == nil {
+			t.Errorf("parseServerVersion(%q) = %d, want an error", version, got)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/lib/pq"
+	"github.com/rubenv/sql-migrate"
+)
+
+// runCIValidate creates a uniquely named database next to the one in baseDSN,
+// applies every migration up and then down in it, and drops it again
+func runCIValidate(baseDSN string) error {
+	if len(baseDSN) == 0 {
+		return errors.New("Missing required env, CI_VALIDATE_DSN")
+	}
+	// The temporary database is reached by swapping the URL's path, so check
+	// that works before creating anything that would be left behind
+	tempURL, err := url.Parse(baseDSN)
+	if err != nil || (tempURL.Scheme != "postgres" && tempURL.Scheme != "postgresql") {
+		return errors.New("CI_VALIDATE_DSN must be a postgres:// or postgresql:// URL")
+	}
+	if err := requireNetwork("-ci-validate"); err != nil {
+		return err
+	}
+	source, err := migrationSource()
+	if err != nil {
+		return err
+	}
+
+	// The base connection needs CREATEDB rights
+	base, err := sql.Open("postgres", baseDSN)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tempName := fmt.Sprintf("migrator_ci_%x", suffix)
+	if _, err := base.Exec("CREATE DATABASE " + pq.QuoteIdentifier(tempName)); err != nil {
+		return fmt.Errorf("Could not create temporary database: %+v", err)
+	}
+	logln("Created temporary database: ", tempName)
+	defer func() {
+		if _, err := base.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(tempName)); err != nil {
+			logln("Could not drop temporary database: ", err)
+			return
+		}
+		logln("Dropped temporary database: ", tempName)
+	}()
+
+	tempURL.Path = "/" + tempName
+	db, err := sql.Open("postgres", tempURL.String())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	up, err := applyMigrations(db, source, migrate.Up, 0, applyOptions{})
+	if err != nil {
+		return fmt.Errorf("Applying migrations up failed after %d migrations: %+v", up, err)
+	}
+	logf("Applied %d migrations up!\n", up)
+
+	down, err := applyMigrations(db, source, migrate.Down, 0, applyOptions{})
+	if err != nil {
+		return fmt.Errorf("Applying migrations down failed after %d migrations: %+v", down, err)
+	}
+	logf("Applied %d migrations down!\n", down)
+	return nil
+}
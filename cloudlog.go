@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	logging "google.golang.org/api/logging/v2"
+	"google.golang.org/api/option"
+)
+
+// CloudLogWriteTimeout bounds each write to Cloud Logging, so an outage can't stall a run
+const CloudLogWriteTimeout = 10 * time.Second
+
+// cloudLogger writes the key events of a run as structured Cloud Logging entries
+type cloudLogger struct {
+	svc     *logging.Service
+	logName string
+	project string
+	labels  map[string]string
+}
+
+// The run's Cloud Logging sink under CLOUD_LOGGING_LOG_NAME, nil when unset
+var cloudLog *cloudLogger
+
+// startCloudLogging sets up the Cloud Logging sink with the default
+// credentials. The project is the credentials' one, or else the instance's
+func startCloudLogging(name string, t *target) error {
+	if len(name) == 0 {
+		return nil
+	}
+	if err := requireNetwork("writing to Cloud Logging"); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	client, creds, err := googleHTTPClient(ctx, logging.LoggingWriteScope)
+	if err != nil {
+		return fmt.Errorf("CLOUD_LOGGING_LOG_NAME: %+v", err)
+	}
+	project := creds.ProjectID
+	if len(project) == 0 {
+		if project, _, err = splitConnectionName(t.instanceID); err != nil {
+			return err
+		}
+	}
+	svc, err := logging.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return err
+	}
+
+	cloudLog = &cloudLogger{
+		svc:     svc,
+		logName: "projects/" + project + "/logs/" + url.PathEscape(name),
+		project: project,
+		labels:  map[string]string{"instance": t.instanceID, "database": t.dbName},
+	}
+	logf("Writing run events to Cloud Logging: %s\n", cloudLog.logName)
+	return nil
+}
+
+// event writes one event with its fields to Cloud Logging, nothing on a nil
+// sink. A failed write is only a warning, the console log has everything too
+func (l *cloudLogger) event(severity, event, message string, fields map[string]interface{}) {
+	if l == nil {
+		return
+	}
+
+	payload := map[string]interface{}{"event": event, "message": message}
+	for k, v := range fields {
+		payload[k] = v
+	}
+	bytez, err := json.Marshal(payload)
+	if err != nil {
+		logln("Warning, could not encode Cloud Logging entry: ", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CloudLogWriteTimeout)
+	defer cancel()
+	_, err = l.svc.Entries.Write(&logging.WriteLogEntriesRequest{
+		LogName:  l.logName,
+		Resource: &logging.MonitoredResource{Type: "global", Labels: map[string]string{"project_id": l.project}},
+		Labels:   l.labels,
+		Entries: []*logging.LogEntry{{
+			Severity:    severity,
+			Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+			JsonPayload: bytez,
+		}},
+	}).Context(ctx).Do()
+	if err != nil {
+		logln("Warning, could not write to Cloud Logging: ", err)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rubenv/sql-migrate"
+)
+
+// Set at release time by goreleaser through -ldflags
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// DefaultCommand runs when no subcommand is given, keeping the env driven
+// container behavior
+const DefaultCommand = "migrate"
+
+// command is a subcommand of the migrator
+type command struct {
+	usage string
+	run   func(args []string)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"migrate":  {"start the proxy and apply pending migrations (default)", runMigrate},
+		"status":   {"list migrations and whether they are applied", runStatus},
+		"new":      {"create a new, empty migration file: new NAME", runNew},
+		"validate": {"parse and lint the migrations without connecting", runValidate},
+		"force":    {"mark a migration applied, or not with -down, without running it: force ID", runForce},
+		"diff":     {"print the schema changes of the pending migrations, then roll back", runDiff},
+		"plan":     {"report the pending migrations without applying them, see PLAN_REPORT_FORMAT", runPlan},
+		"version":  {"print the migrator version", runVersion},
+		"help":     {"print this help", func([]string) { printUsage() }},
+	}
+}
+
+// commandFromArgs splits the subcommand from its arguments. Without one, or
+// when the arguments start with a flag, the default command runs
+func commandFromArgs(args []string) (string, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return DefaultCommand, args
+	}
+	return args[0], args[1:]
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: migrator [command] [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, name := range []string{"migrate", "status", "new", "validate", "force", "diff", "plan", "version", "help"} {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun 'migrator COMMAND -h' for the flags of a command. Add -offline to any")
+	fmt.Fprintln(os.Stderr, "command to make sure it never touches the network.")
+}
+
+// openTargetDB brings up the proxy and connects, for the commands beside
+// migrate that need the database. The caller must kill the proxy when done
+func openTargetDB() (*sql.DB, *target) {
+	pError(loadSharedEnv())
+	t, err := loadTarget()
+	pError(err)
+	trapKillForCleanup()
+
+	budget := &retryBudget{}
+	pError(t.startProxy(budget))
+	proxyCMD, proxyDone = t.cmd, t.done
+	db, err := t.openDB(budget)
+	pError(err)
+	pError(checkTargetDatabase(db, t.dbName))
+	return db, t
+}
+
+// migrationStatus is one line of the status command
+type migrationStatus struct {
+	ID        string     `json:"id"`
+	State     string     `json:"state"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+func runStatus(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	forRelease := fs.String("migrations-for-release", "", "only list the migrations applied under this RELEASE_VERSION")
+	fs.Parse(args)
+
+	migrations, err := migrationSource()
+	pError(err)
+	db, _ := openTargetDB()
+	defer ensureProcessKill(proxyCMD)
+
+	if len(*forRelease) > 0 {
+		pError(printMigrationsForRelease(db, *forRelease))
+		return
+	}
+
+	records, err := migrate.GetMigrationRecords(db, "postgres")
+	pError(err)
+	appliedAt := make(map[string]time.Time, len(records))
+	for _, r := range records {
+		appliedAt[r.Id] = r.AppliedAt
+	}
+	all, err := migrations.FindMigrations()
+	pError(err)
+
+	var statuses []migrationStatus
+	known := map[string]bool{}
+	for _, m := range all {
+		known[m.Id] = true
+		st := migrationStatus{ID: m.Id, State: "pending"}
+		if at, ok := appliedAt[m.Id]; ok {
+			st.State, st.AppliedAt = "applied", &at
+		}
+		statuses = append(statuses, st)
+	}
+	for _, r := range records {
+		if !known[r.Id] {
+			at := r.AppliedAt
+			statuses = append(statuses, migrationStatus{ID: r.Id, State: "unknown", AppliedAt: &at})
+		}
+	}
+
+	if *asJSON {
+		bytez, err := json.MarshalIndent(statuses, "", "  ")
+		pError(err)
+		outputf("%s\n", bytez)
+		return
+	}
+	for _, st := range statuses {
+		at := ""
+		if st.AppliedAt != nil {
+			at = st.AppliedAt.Format(time.RFC3339)
+		}
+		outputf("%-8s %-25s %s\n", st.State, at, st.ID)
+	}
+}
+
+// newMigrationTemplate is the content of a freshly created migration
+const newMigrationTemplate = `-- +migrate Up
+
+-- +migrate Down
+`
+
+func runNew(args []string) {
+	fs := flag.NewFlagSet("new", flag.ExitOnError)
+	ext := fs.String("ext", DefaultMigrationExtension, "file extension of the new migration")
+	createDir := fs.Bool("create-dir", true, "create the migrations folder when it doesn't exist yet")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		pError(errors.New("Usage: migrator new [-create-dir=false] NAME"))
+	}
+
+	// Scaffolding a fresh project starts without a folder, migrate still requires one
+	dir := migrationsPath()
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) && *createDir {
+		pError(os.MkdirAll(dir, 0755))
+		logln("Created migrations folder: ", dir)
+		info, err = os.Stat(dir)
+	}
+	if err != nil {
+		pError(errors.New("Migrations folder missing"))
+	}
+	if !info.IsDir() {
+		pError(fmt.Errorf("MIGRATIONS_DIR %s is a single migration file, there is no folder to add to", dir))
+	}
+	name := strings.Join(strings.Fields(fs.Arg(0)), "_")
+	path := filepath.Join(dir, fmt.Sprintf("%s_%s%s", time.Now().UTC().Format("20060102150405"), name, *ext))
+	if _, err := os.Stat(path); err == nil {
+		pError(fmt.Errorf("Migration %s already exists", path))
+	}
+	pError(ioutil.WriteFile(path, []byte(newMigrationTemplate), 0644))
+	logln("Created migration: ", path)
+}
+
+func runValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Parse(args)
+
+	migrations, err := migrationSource()
+	pError(err)
+	pError(verifyMigrationsFromEnv(migrations))
+	if validator := os.Getenv("MIGRATION_VALIDATOR_CMD"); len(strings.TrimSpace(validator)) > 0 {
+		pError(runValidatorCommand(validator, migrations))
+	}
+	if os.Getenv("REQUIRE_DOWN") == "true" {
+		pError(checkDownSections(migrations))
+	}
+
+	found, err := migrations.FindMigrations()
+	pError(err)
+	logf("%d migrations are valid!\n", len(found))
+}
+
+func runForce(args []string) {
+	fs := flag.NewFlagSet("force", flag.ExitOnError)
+	down := fs.Bool("down", false, "remove the migration from the tracking table instead of adding it")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		pError(errors.New("Usage: migrator force [-down] ID"))
+	}
+	id := fs.Arg(0)
+
+	migrations, err := migrationSource()
+	pError(err)
+	db, _ := openTargetDB()
+	defer ensureProcessKill(proxyCMD)
+
+	applied, err := appliedMigrationIDs(db)
+	pError(err)
+	if *down {
+		if !applied[id] {
+			pError(fmt.Errorf("Migration %s is not applied", id))
+		}
+		pError(recordMigration(db, id, migrate.Down))
+		logln("Marked migration as not applied: ", id)
+		return
+	}
+
+	all, err := migrations.FindMigrations()
+	pError(err)
+	exists := false
+	for _, m := range all {
+		exists = exists || m.Id == id
+	}
+	if !exists {
+		pError(fmt.Errorf("Migration %s is not in %s", id, migrationsPath()))
+	}
+	if applied[id] {
+		pError(fmt.Errorf("Migration %s is already applied", id))
+	}
+	pError(recordMigration(db, id, migrate.Up))
+	logln("Marked migration as applied without running it: ", id)
+}
+
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Parse(args)
+
+	migrations, err := migrationSource()
+	pError(err)
+	db, _ := openTargetDB()
+	defer ensureProcessKill(proxyCMD)
+
+	pError(printSchemaDiff(db, migrations))
+}
+
+func runPlan(args []string) {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	fs.Parse(args)
+
+	format := os.Getenv("PLAN_REPORT_FORMAT")
+	if len(format) == 0 {
+		format = DefaultPlanReportFormat
+	}
+	// Fail on a bad format before bringing up the proxy
+	_, err := formatPlan(nil, format)
+	pError(err)
+
+	migrations, err := migrationSource()
+	pError(err)
+	db, _ := openTargetDB()
+	defer ensureProcessKill(proxyCMD)
+
+	// Optionally go through the migrate command's lock cycle, to test contention
+	var lock *migrationLock
+	if os.Getenv("DRY_RUN_WITH_LOCK") == "true" && useAdvisoryLock() {
+		retries, waitTimeout, err := lockSettings()
+		pError(err)
+		lock, err = acquireMigrationLock(db, trackingTableLabel(), retries, waitTimeout)
+		pError(err)
+	}
+	entries, err := pendingPlan(db, migrations)
+	pError(err)
+	if lock != nil {
+		pError(lock.release())
+		logln("Released the migration lock, nothing was applied")
+	}
+	report, err := formatPlan(entries, format)
+	pError(err)
+	pError(writePlanReport(report, os.Getenv("PLAN_OUTPUT_FILE")))
+
+	// Optionally show the plan to reviewers on the pull request
+	comment, err := formatPlan(entries, "markdown")
+	pError(err)
+	reportToGitHub(comment, true, fmt.Sprintf("%d pending migrations", len(entries)))
+}
+
+func runVersion(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	fs.Parse(args)
+
+	outputf("migrator %s (commit %s, built %s)\n", version, commit, date)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+)
+
+// setting is an environment variable the migrator reads, with its default
+type setting struct {
+	name   string
+	def    string
+	redact func(string) string
+}
+
+// redactSecret hides a secret value entirely
+func redactSecret(string) string { return "(redacted)" }
+
+// knownSettings lists every environment variable the migrator reads, for -print-config
+var knownSettings = []setting{
+	{name: "ALLOW_TRACKING_TABLE_MODIFICATION"},
+	{name: "APP_HEALTHCHECK_DSN", redact: redactedDSN},
+	{name: "APP_HEALTHCHECK_QUERY", def: DefaultAppHealthcheckQuery},
+	{name: "BLOCKER_MIN_DURATION", def: DefaultBlockerMinDuration.String()},
+	{name: "CA_CERT_FILE"},
+	{name: "CI_VALIDATE_DSN", redact: redactedDSN},
+	{name: "CLOUD_LOGGING_LOG_NAME"},
+	{name: "CONFIRM_REDO"},
+	{name: "CONFIRM_RESUME"},
+	{name: "CONFIRM_SKIP"},
+	{name: "CONFIRM_TERMINATE_BLOCKERS"},
+	{name: "CONN_KEEPALIVE_INTERVAL"},
+	{name: "DB_NAME"},
+	{name: "DB_PASS", redact: redactSecret},
+	{name: "DB_SCHEMA"},
+	{name: "DB_USER"},
+	{name: "DEPLOY_ID"},
+	{name: "DROP_INVALID_INDEX"},
+	{name: "DISK_MIN_FREE_PERCENT", def: strconv.Itoa(DefaultDiskMinFreePercent)},
+	{name: "DISK_PREFLIGHT"},
+	{name: "DRY_RUN_WITH_LOCK"},
+	{name: "ENVIRONMENT"},
+	{name: "FAIL_ON_EMPTY_MIGRATION"},
+	{name: "FAIL_ON_INVALID_INDEX"},
+	{name: "FAIL_ON_LOW_DISK"},
+	{name: "FAIL_ON_WARNING"},
+	{name: "GITHUB_API_URL", def: DefaultGitHubAPIURL},
+	{name: "GITHUB_REPO"},
+	{name: "GITHUB_SHA"},
+	{name: "GITHUB_TOKEN", redact: redactSecret},
+	{name: "GOOGLE_APPLICATION_CREDENTIALS"},
+	{name: "HEALTH_ADDR"},
+	{name: "IGNORE_SQLSTATES"},
+	{name: "INSTANCE_NAME_FILTER"},
+	{name: "KILL_TIMEOUT", def: DefaultKillTimeout.String()},
+	{name: "LOCK_ACQUIRE_RETRIES", def: strconv.Itoa(DefaultLockAcquireRetries)},
+	{name: "LOCK_WAIT_TIMEOUT", def: DefaultLockWaitTimeout.String()},
+	{name: "LOG_BUFFER_LINES", def: strconv.Itoa(DefaultLogBufferLines)},
+	{name: "MAX_MIGRATION_FILE_MB"},
+	{name: "METRICS_TEXTFILE"},
+	{name: "MIGRATIONS_DIR", def: MigrationsFolder},
+	{name: "MIGRATIONS_MANIFEST"},
+	{name: "MIGRATIONS_PUBKEY"},
+	{name: "MIGRATIONS_SIGNATURE"},
+	{name: "MIGRATIONS_TABLE", def: DefaultMigrationsTable},
+	{name: "MIGRATION_EXTENSIONS", def: DefaultMigrationExtension},
+	{name: "MIGRATION_PLAN"},
+	{name: "MIGRATION_RELEASES_TABLE", def: DefaultReleasesTable},
+	{name: "MIGRATION_TIMINGS_FILE"},
+	{name: "MIGRATION_TIMINGS_TABLE"},
+	{name: "MIGRATION_VALIDATOR_CMD"},
+	{name: "MIN_SERVER_VERSION"},
+	{name: "NOCHANGE_EXIT_CODE", def: "0"},
+	{name: "NOCHANGE_MESSAGE", def: NoChangeMessage},
+	{name: "OFFLINE"},
+	{name: "ON_READY_COMMAND"},
+	{name: "OPERATOR"},
+	{name: "PER_MIGRATION_TIMEOUT"},
+	{name: "PGBOUNCER_MODE"},
+	{name: "PING_TIMEOUT", def: DefaultPingTimeout.String()},
+	{name: "PLAN_OUTPUT_FILE"},
+	{name: "PLAN_REPORT_FORMAT", def: DefaultPlanReportFormat},
+	{name: "POST_MIGRATE_ANALYZE"},
+	{name: "POST_MIGRATE_ANALYZE_FALLBACK", def: "all"},
+	{name: "PRODUCTION_DB_PATTERN", def: ProductionDBPattern},
+	{name: "PROXY_LOG_FILE"},
+	{name: "PROXY_PORT_PROBE"},
+	{name: "PROXY_RUN_AS_GID"},
+	{name: "PROXY_RUN_AS_UID"},
+	{name: "PR_NUMBER"},
+	{name: "RECONNECT_RETRIES", def: strconv.Itoa(DefaultReconnectRetries)},
+	{name: "REDO_LAST"},
+	{name: "RELEASE_VERSION"},
+	{name: "REQUIRE_DOWN"},
+	{name: "RESUME_REQUIRES_CONFIRMATION"},
+	{name: "RUN_RETRY_BUDGET"},
+	{name: "RUN_RETRY_WINDOW"},
+	{name: "SCHEMA_DIFF"},
+	{name: "SCHEMA_DUMP_FILE"},
+	{name: "SCHEMA_DUMP_REQUIRED"},
+	{name: "SHADOW_CLONE_INSTANCE"},
+	{name: "SKIP_ADVISORY_LOCK"},
+	{name: "SKIP_MIGRATIONS"},
+	{name: "SKIP_READONLY_CHECK"},
+	{name: "SKIP_VERSION_CHECK"},
+	{name: "SQLADMIN_ENDPOINT"},
+	{name: "SQL_INSTANCE_ID"},
+	{name: "STREAM_LARGE_MIGRATIONS"},
+	{name: "STRICT_PREFIX"},
+	{name: "STRICT_TRACKING"},
+	{name: "SUMMARY_FILE"},
+	{name: "TERMINATE_BLOCKERS"},
+	{name: "TERMINATE_BLOCKERS_ALLOWLIST"},
+	{name: "TERMINATION_LOG_ON_SUCCESS"},
+	{name: "TERMINATION_LOG_PATH", def: TerminationLogPath},
+	{name: "WAIT_FOR_QUERY"},
+	{name: "WAIT_FOR_TIMEOUT", def: DefaultWaitForTimeout.String()},
+}
+
+// resolvedSetting is one line of -print-config
+type resolvedSetting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// printConfig prints the effective value of every setting and where it came
+// from, env or default, with secrets redacted
+func printConfig() error {
+	resolved := make([]resolvedSetting, 0, len(knownSettings))
+	for _, s := range knownSettings {
+		r := resolvedSetting{Name: s.name, Value: s.def, Source: "default"}
+		if value, ok := os.LookupEnv(s.name); ok && len(value) > 0 {
+			r.Value, r.Source = value, "env"
+		} else if len(s.def) == 0 {
+			r.Source = "unset"
+		}
+		if s.redact != nil && len(r.Value) > 0 {
+			r.Value = s.redact(r.Value)
+		}
+		resolved = append(resolved, r)
+	}
+
+	bytez, err := json.MarshalIndent(resolved, "", "  ")
+	if err != nil {
+		return err
+	}
+	outputf("%s\n", bytez)
+	return nil
+}
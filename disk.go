@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rubenv/sql-migrate"
+)
+
+// spaceIntensiveMarker flags a migration that needs a lot of free disk, like
+// a big index build or table rewrite. It goes above the Up annotation
+const spaceIntensiveMarker = "-- +migrator space-intensive"
+
+// DefaultDiskMinFreePercent is the free disk DISK_PREFLIGHT asks for, see DISK_MIN_FREE_PERCENT
+const DefaultDiskMinFreePercent = 20
+
+// isSpaceIntensive reports whether a migration file carries the space-intensive
+// marker, looking no further than its Down section
+func isSpaceIntensive(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	flagged := false
+	err = readLines(file, func(line string) (bool, error) {
+		// A marker in the Down section doesn't count, applying doesn't run it
+		if fields := migrateCommand(line); len(fields) > 0 && fields[0] == "Down" {
+			return false, nil
+		}
+		flagged = strings.TrimSpace(line) == spaceIntensiveMarker
+		return !flagged, nil
+	})
+	return flagged, err
+}
+
+// instanceDiskBytes reads the instance's data disk size from the Cloud SQL Admin API
+func instanceDiskBytes(instanceID string) (int64, error) {
+	project, name, err := splitConnectionName(instanceID)
+	if err != nil {
+		return 0, err
+	}
+	ctx := context.Background()
+	svc, _, err := newSQLAdminService(ctx)
+	if err != nil {
+		return 0, err
+	}
+	instance, err := svc.Instances.Get(project, name).Context(ctx).Do()
+	if err != nil {
+		return 0, fmt.Errorf("Could not read instance %s: %+v", instanceID, err)
+	}
+	if instance.Settings == nil || instance.Settings.DataDiskSizeGb == 0 {
+		return 0, fmt.Errorf("Instance %s doesn't report a disk size", instanceID)
+	}
+	return instance.Settings.DataDiskSizeGb << 30, nil
+}
+
+// checkDiskSpace warns, or fails under fail, when the instance has less than
+// DISK_MIN_FREE_PERCENT of its disk free before pending space-intensive
+// migrations. Used space is the size of all databases, which leaves out WAL
+// and temp files, so it is an optimistic estimate
+func checkDiskSpace(db *sql.DB, source *extensionMigrationSource, instanceID string, fail bool) error {
+	minFree := DefaultDiskMinFreePercent
+	if value := os.Getenv("DISK_MIN_FREE_PERCENT"); len(value) > 0 {
+		var err error
+		minFree, err = strconv.Atoi(value)
+		if err != nil || minFree < 0 || minFree > 100 {
+			return fmt.Errorf("Invalid DISK_MIN_FREE_PERCENT %q, expected a percentage from 0 to 100", value)
+		}
+	}
+
+	planned, _, err := migrate.PlanMigration(db, "postgres", source, migrate.Up, 0)
+	if err != nil {
+		return err
+	}
+	var intensive []string
+	for _, m := range planned {
+		flagged, err := isSpaceIntensive(filepath.Join(source.Dir, m.Id))
+		if err != nil {
+			return err
+		}
+		if flagged {
+			intensive = append(intensive, m.Id)
+		}
+	}
+	if len(intensive) == 0 {
+		return nil
+	}
+
+	total, err := instanceDiskBytes(instanceID)
+	if err != nil {
+		return err
+	}
+	var used int64
+	if err := db.QueryRow("SELECT sum(pg_database_size(datname))::bigint FROM pg_database").Scan(&used); err != nil {
+		return fmt.Errorf("Could not read the database sizes: %+v", err)
+	}
+	free := total - used
+	freePercent := float64(free) * 100 / float64(total)
+	logf("Disk preflight: about %.1f GB of %.1f GB free (%.0f%%) before space-intensive migrations %s\n", float64(free)/(1<<30), float64(total)/(1<<30), freePercent, strings.Join(intensive, ", "))
+	if freePercent >= float64(minFree) {
+		return nil
+	}
+
+	msg := fmt.Sprintf("only %.0f%% of the instance disk is free, below DISK_MIN_FREE_PERCENT=%d, before space-intensive migrations: %s", freePercent, minFree, strings.Join(intensive, ", "))
+	if fail {
+		return fmt.Errorf("Refusing to migrate, %s. Grow the disk or turn on storage auto resize first", msg)
+	}
+	logln("Warning, ", msg)
+	return nil
+}
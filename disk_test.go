@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsSpaceIntensive(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		content string
+		want    bool
+	}{
+		{"-- +migrator space-intensive\n-- +migrate Up\nCREATE INDEX i ON t (c);\n", true},
+		{"-- +migrate Up\nCREATE INDEX i ON t (c);\n", false},
+		{"-- +migrate Up\nCREATE TABLE t (c int);\n-- +migrate Down\n-- +migrator space-intensive\nDROP TABLE t;\n", false},
+	} {
+		path := filepath.Join(dir, "1_test.sql")
+		if err := ioutil.WriteFile(path, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := isSpaceIntensive(path); err != nil || got != tc.want {
+			t.Errorf("isSpaceIntensive(%q) = %v, %v, want %v", tc.content, got, err, tc.want)
+		}
+	}
+}
+
+func TestSplitConnectionName(t *testing.T) {
+	for _, tc := range []struct {
+		name, project, instance string
+	}{
+		{"proj:europe-west1:db", "proj", "db"},
+		{"example.com:proj:us-central1:db", "example.com:proj", "db"},
+	} {
+		project, instance, err := splitConnectionName(tc.name)
+		if err != nil || project != tc.project || instance != tc.instance {
+			t.Errorf("splitConnectionName(%q) = %q, %q, %v, want %q, %q", tc.name, project, instance, err, tc.project, tc.instance)
+		}
+	}
+
+	for _, name := range []string{"", "db", "proj:db", ":europe-west1:db", "proj::db", "proj:europe-west1:"} {
+		if _, _, err := splitConnectionName(name); err == nil {
+			t.Errorf("splitConnectionName(%q) succeeded, want an error", name)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultGitHubAPIURL is the GitHub API, GITHUB_API_URL points at an Enterprise server instead
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+// GitHubStatusContext names the commit status the migrator sets
+const GitHubStatusContext = "migrator"
+
+// GitHubMaxCommentBytes stays under GitHub's 65536 character limit for comment bodies
+const GitHubMaxCommentBytes = 60000
+
+// GitHubMaxStatusDescription is the longest commit status description GitHub accepts
+const GitHubMaxStatusDescription = 140
+
+// reportToGitHub posts body as a comment on PR_NUMBER of GITHUB_REPO and sets
+// a commit status on GITHUB_SHA, whichever of them is configured. It does
+// nothing without GITHUB_TOKEN and GITHUB_REPO. A failed post is only a
+// warning, it shouldn't change the outcome of the run being reported
+func reportToGitHub(body string, ok bool, description string) {
+	token, repo := os.Getenv("GITHUB_TOKEN"), os.Getenv("GITHUB_REPO")
+	if len(token) == 0 || len(repo) == 0 {
+		return
+	}
+	if err := requireNetwork("reporting to GitHub"); err != nil {
+		logln("Warning, ", err)
+		return
+	}
+	api := strings.TrimRight(os.Getenv("GITHUB_API_URL"), "/")
+	if len(api) == 0 {
+		api = DefaultGitHubAPIURL
+	}
+
+	if pr := os.Getenv("PR_NUMBER"); len(pr) > 0 {
+		if len(body) > GitHubMaxCommentBytes {
+			body = truncateUTF8(body, GitHubMaxCommentBytes) + "\n\n_Truncated, see the job log for the rest._\n"
+		}
+		err := postGitHub(token, api+"/repos/"+repo+"/issues/"+pr+"/comments", map[string]string{"body": body})
+		if err != nil {
+			logln("Warning, could not comment on the pull request: ", err)
+		} else {
+			logf("Commented on pull request %s#%s\n", repo, pr)
+		}
+	}
+
+	if sha := os.Getenv("GITHUB_SHA"); len(sha) > 0 {
+		if len(description) > GitHubMaxStatusDescription {
+			description = truncateUTF8(description, GitHubMaxStatusDescription-3) + "..."
+		}
+		state := "success"
+		if !ok {
+			state = "failure"
+		}
+		err := postGitHub(token, api+"/repos/"+repo+"/statuses/"+sha, map[string]string{
+			"state":       state,
+			"description": description,
+			"context":     GitHubStatusContext,
+		})
+		if err != nil {
+			logln("Warning, could not set the commit status: ", err)
+		} else {
+			logf("Set commit status %s on %s\n", state, sha)
+		}
+	}
+}
+
+// postGitHub sends payload as JSON to a GitHub API url
+func postGitHub(token, url string, payload interface{}) error {
+	bytez, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(bytez))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+
+	base, err := outboundHTTPClient()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: base.Transport, Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("GitHub answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// ciValidateReport is the PR comment and status description for a -ci-validate result
+func ciValidateReport(err error) (string, string) {
+	if err == nil {
+		return "### Migration validation passed\n\nEvery migration applied up and down cleanly on a temporary database.\n", "Migrations apply up and down cleanly"
+	}
+	msg := fmt.Sprintf("%+v", err)
+	fence := markdownFence(msg)
+	return fmt.Sprintf("### Migration validation failed\n\n%s\n%s\n%s\n", fence, msg, fence), "Migration validation failed: " + msg
+}
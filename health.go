@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultLogBufferLines is how many recent log lines /logs keeps, see LOG_BUFFER_LINES
+const DefaultLogBufferLines = 500
+
+// MaxLogBufferLines bounds LOG_BUFFER_LINES so the buffer can't grow without limit
+const MaxLogBufferLines = 10000
+
+// logRing keeps the most recent log lines, proxy output included
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+// recentLogs is fed by the log writer and served at /logs
+var recentLogs = newLogRing(DefaultLogBufferLines)
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([]string, size)}
+}
+
+// add stores every line of text, dropping the oldest once full
+func (r *logRing) add(text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		r.lines[r.next] = line
+		r.next = (r.next + 1) % len(r.lines)
+		r.full = r.full || r.next == 0
+	}
+}
+
+// last returns up to n of the most recent lines, oldest first
+func (r *logRing) last(n int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ordered []string
+	if r.full {
+		ordered = append(ordered, r.lines[r.next:]...)
+	}
+	ordered = append(ordered, r.lines[:r.next]...)
+	if n > 0 && n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
+
+// resize empties the buffer and changes its capacity
+func (r *logRing) resize(size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines, r.next, r.full = make([]string, size), 0, false
+}
+
+// startHealthServer serves /healthz and the recent logs at /logs on addr
+func startHealthServer(addr string) error {
+	if err := requireNetwork("HEALTH_ADDR"); err != nil {
+		return err
+	}
+	if value := os.Getenv("LOG_BUFFER_LINES"); len(value) > 0 {
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 || size > MaxLogBufferLines {
+			return fmt.Errorf("Invalid LOG_BUFFER_LINES %q, expected 1 to %d lines", value, MaxLogBufferLines)
+		}
+		recentLogs.resize(size)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/logs", serveLogs)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Could not listen on HEALTH_ADDR %s: %+v", addr, err)
+	}
+	logln("Serving /healthz and /logs on: ", listener.Addr())
+	go http.Serve(listener, mux)
+	return nil
+}
+
+// serveLogs returns the last ?n= lines, all buffered by default, as plain
+// text or with ?format=json as a JSON array
+func serveLogs(w http.ResponseWriter, r *http.Request) {
+	n := 0
+	if value := r.URL.Query().Get("n"); len(value) > 0 {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n <= 0 {
+			http.Error(w, "n must be a positive number of lines", http.StatusBadRequest)
+			return
+		}
+	}
+	lines := recentLogs.last(n)
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if lines == nil {
+			lines = []string{}
+		}
+		json.NewEncoder(w).Encode(lines)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
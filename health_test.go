@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeLogsLineCount(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		code  int
+	}{
+		{"", http.StatusOK},
+		{"?n=5", http.StatusOK},
+		{"?n=0", http.StatusBadRequest},
+		{"?n=-1", http.StatusBadRequest},
+		{"?n=abc", http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		serveLogs(rec, httptest.NewRequest("GET", "/logs"+tc.query, nil))
+		if rec.Code != tc.code {
+			t.Errorf("GET /logs%s = %d, want %d", tc.query, rec.Code, tc.code)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// The shared client for the tool's own outbound HTTP, built once on first use
+var (
+	httpClientOnce sync.Once
+	httpClient     *http.Client
+	httpClientErr  error
+)
+
+// outboundHTTPClient is the client for the Google APIs and GitHub. It honors
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY, and trusts the certificates of
+// CA_CERT_FILE next to the system ones. The proxy binary does its own HTTP
+func outboundHTTPClient() (*http.Client, error) {
+	httpClientOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyFromEnvironment
+		if path := os.Getenv("CA_CERT_FILE"); len(path) > 0 {
+			pool, err := loadCACertFile(path)
+			if err != nil {
+				httpClientErr = err
+				return
+			}
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		}
+		httpClient = &http.Client{Transport: transport}
+	})
+	return httpClient, httpClientErr
+}
+
+// loadCACertFile adds the PEM certificates of path to the system roots
+func loadCACertFile(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read CA_CERT_FILE: %+v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA_CERT_FILE %s holds no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// googleHTTPClient finds the default credentials for scope and returns a
+// client that authorizes with them on top of the outbound client, which
+// fetches the tokens too
+func googleHTTPClient(ctx context.Context, scope string) (*http.Client, *google.Credentials, error) {
+	base, err := outboundHTTPClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, base)
+	creds, err := google.FindDefaultCredentials(ctx, scope)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not load Google credentials: %+v", err)
+	}
+	client := &http.Client{Transport: &oauth2.Transport{Source: creds.TokenSource, Base: base.Transport}}
+	return client, creds, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/option"
+	sqladmin "google.golang.org/api/sqladmin/v1"
+)
+
+// newSQLAdminService builds a Cloud SQL Admin API client from the default
+// credentials, on SQLADMIN_ENDPOINT if set, and returns it with the credentials' project
+func newSQLAdminService(ctx context.Context) (*sqladmin.Service, string, error) {
+	if err := requireNetwork("the Cloud SQL Admin API"); err != nil {
+		return nil, "", err
+	}
+	client, creds, err := googleHTTPClient(ctx, sqladmin.SqlserviceAdminScope)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(creds.ProjectID) == 0 {
+		return nil, "", errors.New("The Google credentials don't name a project")
+	}
+
+	opts := []option.ClientOption{option.WithHTTPClient(client)}
+	if len(sqladminEndpoint) > 0 {
+		opts = append(opts, option.WithEndpoint(sqladminEndpoint))
+	}
+	svc, err := sqladmin.NewService(ctx, opts...)
+	if err != nil {
+		return nil, "", err
+	}
+	return svc, creds.ProjectID, nil
+}
+
+// splitConnectionName splits a project:region:instance connection name into
+// its project and instance, from the right, since a domain-scoped project
+// like example.com:proj has a colon of its own
+func splitConnectionName(name string) (project, instance string, err error) {
+	parts := strings.Split(name, ":")
+	n := len(parts)
+	if n < 3 {
+		return "", "", fmt.Errorf("SQL_INSTANCE_ID %q isn't a project:region:instance connection name", name)
+	}
+	project = strings.Join(parts[:n-2], ":")
+	if len(project) == 0 || len(parts[n-2]) == 0 || len(parts[n-1]) == 0 {
+		return "", "", fmt.Errorf("SQL_INSTANCE_ID %q isn't a project:region:instance connection name", name)
+	}
+	return project, parts[n-1], nil
+}
+
+// discoverInstance lists the Cloud SQL instances of the credentials' project
+// and returns the connection name of the only one whose name matches filter
+func discoverInstance(filter string) (string, error) {
+	filterRe, err := regexp.Compile(filter)
+	if err != nil {
+		return "", fmt.Errorf("Invalid INSTANCE_NAME_FILTER %q: %+v", filter, err)
+	}
+
+	ctx := context.Background()
+	svc, project, err := newSQLAdminService(ctx)
+	if err != nil {
+		return "", err
+	}
+	resp, err := svc.Instances.List(project).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("Could not list Cloud SQL instances in project %s: %+v", project, err)
+	}
+
+	var matches, all []string
+	for _, instance := range resp.Items {
+		all = append(all, instance.ConnectionName)
+		if filterRe.MatchString(instance.Name) {
+			matches = append(matches, instance.ConnectionName)
+		}
+	}
+
+	switch len(matches) {
+	case 1:
+		return matches[0], nil
+	case 0:
+		return "", fmt.Errorf("No Cloud SQL instance in project %s matches INSTANCE_NAME_FILTER %q, set SQL_INSTANCE_ID. Instances: %s", project, filter, strings.Join(all, ", "))
+	default:
+		return "", fmt.Errorf("Several Cloud SQL instances in project %s match INSTANCE_NAME_FILTER %q, set SQL_INSTANCE_ID or narrow the filter. Matches: %s", project, filter, strings.Join(matches, ", "))
+	}
+}
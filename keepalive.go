@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// DefaultPingTimeout bounds every ping and heartbeat, see PING_TIMEOUT
+const DefaultPingTimeout = 3 * time.Second
+
+// How long a ping or heartbeat may take before its connection is given up
+var pingTimeout = DefaultPingTimeout
+
+// keepaliveDialer dials the proxy with TCP keepalives every interval
+type keepaliveDialer struct {
+	net.Dialer
+}
+
+func (d *keepaliveDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	dialer := d.Dialer
+	dialer.Timeout = timeout
+	return dialer.Dial(network, address)
+}
+
+// startHeartbeat runs SELECT 1 every interval, so idle connections between
+// long migrations aren't reaped by idle timeouts. Call the returned func to stop
+func startHeartbeat(db *sql.DB, interval time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := withPingTimeout(func(ctx context.Context) error {
+					_, err := db.ExecContext(ctx, "SELECT 1")
+					return err
+				})
+				if err != nil {
+					logln("Warning, connection heartbeat failed: ", err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// pingDB pings the database within PING_TIMEOUT
+func pingDB(db *sql.DB) error {
+	return withPingTimeout(db.PingContext)
+}
+
+// withPingTimeout runs a connectivity check with PING_TIMEOUT. The check is
+// abandoned at the deadline even when the driver keeps waiting on a half-open
+// connection, so the caller can retry on a fresh one. Timeouts and refused
+// connections get their own messages, they point at different problems
+func withPingTimeout(check func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	switch {
+	case err == nil:
+		return nil
+	case ctx.Err() == context.DeadlineExceeded:
+		return fmt.Errorf("Ping timed out after %s (PING_TIMEOUT), the connection may be half-open: %w", pingTimeout, err)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("Connection refused, nothing is listening: %w", err)
+	}
+	return err
+}
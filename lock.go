@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"time"
+)
+
+// DefaultLockAcquireRetries is how often a busy migration lock is retried, see LOCK_ACQUIRE_RETRIES
+const DefaultLockAcquireRetries = 10
+
+// DefaultLockWaitTimeout bounds the total wait for the migration lock, see LOCK_WAIT_TIMEOUT
+const DefaultLockWaitTimeout = 5 * time.Minute
+
+// LockRetryDelay is the first backoff between lock attempts, doubled up to LockMaxRetryDelay
+const LockRetryDelay = time.Second
+
+// LockMaxRetryDelay caps the backoff between lock attempts
+const LockMaxRetryDelay = 30 * time.Second
+
+// migrationLock is a Postgres advisory lock held on its own connection, so
+// concurrent migrators against the same database take turns
+type migrationLock struct {
+	conn *sql.Conn
+	key  int64
+
+	// Waited is set when another migrator held the lock first
+	Waited bool
+}
+
+// useAdvisoryLock is false under SKIP_ADVISORY_LOCK=true, and behind a
+// transaction pooler, where a session lock would end up on a random server connection
+func useAdvisoryLock() bool {
+	return os.Getenv("SKIP_ADVISORY_LOCK") != "true" && !pgbouncerTransactionMode
+}
+
+// lockSettings reads LOCK_ACQUIRE_RETRIES and LOCK_WAIT_TIMEOUT
+func lockSettings() (int, time.Duration, error) {
+	retries, timeout := DefaultLockAcquireRetries, DefaultLockWaitTimeout
+	if value := os.Getenv("LOCK_ACQUIRE_RETRIES"); len(value) > 0 {
+		var err error
+		retries, err = strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return 0, 0, fmt.Errorf("Invalid LOCK_ACQUIRE_RETRIES %q, expected a number of retries", value)
+		}
+	}
+	if value := os.Getenv("LOCK_WAIT_TIMEOUT"); len(value) > 0 {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return 0, 0, fmt.Errorf("Invalid LOCK_WAIT_TIMEOUT %q, expected a duration like 5m", value)
+		}
+	}
+	return retries, timeout, nil
+}
+
+// advisoryLockKey derives the lock key from the tracking table, so migrators
+// sharing a tracking table share the lock
+func advisoryLockKey(table string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("cloudSQLMigrator:" + table))
+	return int64(h.Sum64())
+}
+
+// acquireMigrationLock takes the advisory lock, retrying with backoff while
+// another migrator holds it, up to retries attempts or waitTimeout
+func acquireMigrationLock(db *sql.DB, table string, retries int, waitTimeout time.Duration) (*migrationLock, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open a connection for the migration lock: %+v", err)
+	}
+
+	lock := &migrationLock{conn: conn, key: advisoryLockKey(table)}
+	deadline := time.Now().Add(waitTimeout)
+	delay := LockRetryDelay
+	for attempt := 1; ; attempt++ {
+		var locked bool
+		if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lock.key).Scan(&locked); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Could not take the migration lock: %+v", err)
+		}
+		if locked {
+			logln("Acquired the migration lock")
+			return lock, nil
+		}
+
+		lock.Waited = true
+		if attempt > retries || time.Now().Add(delay).After(deadline) {
+			conn.Close()
+			return nil, fmt.Errorf("Another migrator still holds the migration lock after %d attempts, giving up. Raise LOCK_ACQUIRE_RETRIES or LOCK_WAIT_TIMEOUT to wait longer", attempt)
+		}
+		logf("Migration lock is held by another migrator, retrying in %s (%d/%d)\n", delay, attempt, retries)
+		time.Sleep(delay)
+		if delay *= 2; delay > LockMaxRetryDelay {
+			delay = LockMaxRetryDelay
+		}
+	}
+}
+
+// ensureHeld checks the lock's session survived a dropped connection. Postgres
+// frees a session lock when its connection goes, so after a reconnect the
+// lock is taken again on a new connection, without waiting: when another
+// migrator got it in between, the run stops rather than migrate alongside it
+func (l *migrationLock) ensureHeld(db *sql.DB) error {
+	ctx := context.Background()
+	if err := withPingTimeout(l.conn.PingContext); err == nil {
+		return nil
+	}
+	l.conn.Close()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("Could not open a connection to take the migration lock again: %+v", err)
+	}
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&locked); err != nil {
+		conn.Close()
+		return fmt.Errorf("Could not take the migration lock again after a reconnect: %+v", err)
+	}
+	if !locked {
+		conn.Close()
+		return fmt.Errorf("Lost the migration lock in a reconnect and another migrator holds it now, stopping")
+	}
+	l.conn = conn
+	logln("Took the migration lock again after a reconnect")
+	return nil
+}
+
+// release gives the lock back and closes its connection
+func (l *migrationLock) release() error {
+	defer l.conn.Close()
+	if _, err := l.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", l.key); err != nil {
+		return fmt.Errorf("Could not release the migration lock: %+v", err)
+	}
+	return nil
+}
+
+// DefaultWaitForTimeout bounds the wait for WAIT_FOR_QUERY, see WAIT_FOR_TIMEOUT
+const DefaultWaitForTimeout = 10 * time.Minute
+
+// waitForQuery runs query, a predicate returning one boolean, with the lock's
+// backoff until it returns true, e.g. while another schema tool holds its own
+// lock or flag. WAIT_FOR_TIMEOUT bounds the wait
+func waitForQuery(db *sql.DB, query, timeoutValue string) error {
+	timeout := DefaultWaitForTimeout
+	if len(timeoutValue) > 0 {
+		var err error
+		timeout, err = time.ParseDuration(timeoutValue)
+		if err != nil || timeout < 0 {
+			return fmt.Errorf("Invalid WAIT_FOR_TIMEOUT %q, expected a duration like 10m", timeoutValue)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	delay := LockRetryDelay
+	for attempt := 1; ; attempt++ {
+		var ready bool
+		if err := db.QueryRow(query).Scan(&ready); err != nil {
+			return fmt.Errorf("Could not run WAIT_FOR_QUERY, it should return a single boolean: %+v", err)
+		}
+		if ready {
+			if attempt > 1 {
+				logln("WAIT_FOR_QUERY is true, continuing")
+			}
+			return nil
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("WAIT_FOR_QUERY was still false after %s, giving up. Raise WAIT_FOR_TIMEOUT to wait longer", timeout)
+		}
+		logf("WAIT_FOR_QUERY is false, checking again in %s (attempt %d)\n", delay, attempt)
+		time.Sleep(delay)
+		if delay *= 2; delay > LockMaxRetryDelay {
+			delay = LockMaxRetryDelay
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// LogTimeFormat stamps every log line, written by the single log writer so
+// the stamps follow the order of the lines
+const LogTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// logEntry is one message for the log writer. Plain messages are command
+// output and aren't stamped, an entry with done set is a sync request
+type logEntry struct {
+	text  string
+	plain bool
+	done  chan struct{}
+}
+
+// logEntries feeds the log writer, so goroutines never write to stdout themselves
+var logEntries = make(chan logEntry, 1024)
+
+func init() {
+	go writeLogs(os.Stdout, logEntries)
+}
+
+// writeLogs writes the entries one at a time, in the order they were sent
+func writeLogs(w io.Writer, entries <-chan logEntry) {
+	for entry := range entries {
+		if entry.done != nil {
+			close(entry.done)
+			continue
+		}
+		if !entry.plain {
+			entry.text = time.Now().UTC().Format(LogTimeFormat) + " " + entry.text
+			recentLogs.add(entry.text)
+		}
+		io.WriteString(w, entry.text)
+	}
+}
+
+// logln logs the operands like fmt.Println
+func logln(a ...interface{}) {
+	logEntries <- logEntry{text: fmt.Sprintln(a...)}
+}
+
+// logf logs like fmt.Printf
+func logf(format string, a ...interface{}) {
+	logEntries <- logEntry{text: fmt.Sprintf(format, a...)}
+}
+
+// outputf writes command output like fmt.Printf, in order with the logs but unstamped
+func outputf(format string, a ...interface{}) {
+	logEntries <- logEntry{text: fmt.Sprintf(format, a...), plain: true}
+}
+
+// syncLogs waits until everything logged so far is written, call it before exiting
+func syncLogs() {
+	done := make(chan struct{})
+	logEntries <- logEntry{done: done}
+	<-done
+}
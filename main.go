@@ -1,23 +1,25 @@
 package main
 
 import (
-	"bytes"
 	"database/sql"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
-	"syscall"
 	"time"
+	"unicode/utf8"
 
 	_ "github.com/golang-migrate/migrate/source/file"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/rubenv/sql-migrate"
 )
 
@@ -27,59 +29,198 @@ const SQLCloudProxyBinary = "cloud_sql_proxy"
 // MigrationsFolder is the name of the local (required) folder that holds the migrations
 const MigrationsFolder = "migrations"
 
+// DefaultMigrationExtension is the file extension treated as a migration when none are configured
+const DefaultMigrationExtension = ".sql"
+
 // SQLCloudProxyPort is the port we're running the proxy on
 const SQLCloudProxyPort = 5800
 
+// ProxyStartTimeout is how long we wait for the proxy to accept connections
+const ProxyStartTimeout = 10 * time.Second
+
+// PGDumpBinary is the name of the binary used to snapshot the schema
+const PGDumpBinary = "pg_dump"
+
+// NoChangeMessage is the default summary printed when there was nothing to
+// apply, NOCHANGE_MESSAGE replaces it with a template over the run summary
+const NoChangeMessage = "Applied 0 migrations!"
+
+// TerminationLogPath is where Kubernetes reads the failure reason of a container from
+const TerminationLogPath = "/dev/termination-log"
+
+// TerminationLogMaxBytes is the most Kubernetes will read from the termination log
+const TerminationLogMaxBytes = 4096
+
+// ProductionDBPattern matches database names that dev-loop modes refuse to touch
+const ProductionDBPattern = `(?i)prod`
+
+// DefaultMigrationsTable is the tracking table sql-migrate uses when none is configured
+const DefaultMigrationsTable = "gorp_migrations"
+
+// RetryDelay is the pause between two attempts of a phase that failed
+const RetryDelay = 2 * time.Second
+
+// DefaultKillTimeout bounds how long we wait for the proxy to be reaped on teardown
+const DefaultKillTimeout = 5 * time.Second
+
 // Proxy CMD ref
 var proxyCMD *exec.Cmd
 
+// Closed once the current proxy process has been reaped
+var proxyDone chan struct{}
+
+// Name of the tracking table, see MIGRATIONS_TABLE
+var trackingTable = DefaultMigrationsTable
+
+// Schema of the tracking table, the search_path default when empty, see DB_SCHEMA
+var trackingSchema string
+
+// How long teardown waits for the proxy to exit, see KILL_TIMEOUT
+var killTimeout = DefaultKillTimeout
+
+// Deadline for each individual migration, 0 for none, see PER_MIGRATION_TIMEOUT
+var perMigrationTimeout time.Duration
+
+// sqlStatePattern matches a five character SQLSTATE code
+var sqlStatePattern = regexp.MustCompile(`^[0-9A-Za-z]{5}$`)
+
+// Set under PGBOUNCER_MODE=transaction, where session state doesn't outlive a transaction
+var pgbouncerTransactionMode bool
+
+// TCP keepalive and heartbeat interval of the database connections, 0 for the defaults, see CONN_KEEPALIVE_INTERVAL
+var keepaliveInterval time.Duration
+
+// Fail a migration that raises a Postgres WARNING, see FAIL_ON_WARNING
+var failOnWarning bool
+
+// Error codes a migration statement may fail with and still count as applied, see IGNORE_SQLSTATES
+var ignoredSQLStates = map[string]bool{}
+
+// Non-default Cloud SQL Admin API endpoint for the proxy and our own calls, see SQLADMIN_ENDPOINT
+var sqladminEndpoint string
+
 func main() {
-	// Step 1: Check for proxy in path, find executable path
-	path, err := checkForProxy()
-	pError(err)
+	args, offline := stripOfflineFlag(os.Args[1:])
+	offlineMode = offline || os.Getenv("OFFLINE") == "true"
+	name, args := commandFromArgs(args)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		printUsage()
+		os.Exit(2)
+	}
+	defer syncLogs()
+	cmd.run(args)
+}
+
+// runMigrate is the default command: start the proxy and apply the pending
+// migrations, configured through the environment
+func runMigrate(args []string) {
+	runStart := time.Now()
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	ciValidate := fs.Bool("ci-validate", false, "apply all migrations up and down against a throwaway database from CI_VALIDATE_DSN, then exit")
+	printEffectiveConfig := fs.Bool("print-config", false, "print the effective configuration, secrets redacted, and exit")
+	squash := fs.Bool("squash", false, "write a baseline SQL file for the migrations up to -upto from the target database, without changing it")
+	squashUpto := fs.String("upto", "", "with -squash, the last migration id or version folded into the baseline")
+	squashFile := fs.String("squash-file", DefaultSquashFile, "with -squash, where to write the baseline")
+	fs.Parse(args)
+
+	if *printEffectiveConfig {
+		pError(printConfig())
+		return
+	}
+
+	// Squashing only reads the reference database to produce an artifact
+	if *squash {
+		runSquash(*squashUpto, *squashFile)
+		return
+	}
+
+	// CI validation runs against a plain Postgres, no proxy or credentials needed
+	if *ciValidate {
+		err := runCIValidate(os.Getenv("CI_VALIDATE_DSN"))
+		comment, description := ciValidateReport(err)
+		reportToGitHub(comment, err == nil, description)
+		pError(err)
+		return
+	}
 
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("Recovered in f", r)
+			logln("Recovered in f", r)
 		}
 	}()
 
-	// Step 2: Check for required credentials file and instance identifier
-	creds := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
-	instanceID := os.Getenv("SQL_INSTANCE_ID")
-	dbName := os.Getenv("DB_NAME")
-	dbPass := os.Getenv("DB_PASS")
-	dbUser := os.Getenv("DB_USER")
-	if len(creds) == 0 {
-		pError(errors.New("Missing required env, GOOGLE_APPLICATION_CREDENTIALS"))
+	// Optional HTTP endpoint for operators of a running sidecar
+	if addr := os.Getenv("HEALTH_ADDR"); len(addr) > 0 {
+		pError(startHealthServer(addr))
 	}
-	if len(instanceID) == 0 {
-		pError(errors.New("Missing required env, SQL_INSTANCE_ID"))
-	}
-	if len(dbName) == 0 {
-		pError(errors.New("Missing required env, DB_NAME"))
-	}
-	if len(dbPass) == 0 {
-		pError(errors.New("Missing required env, DB_USER"))
+
+	// Step 1 & 2: Find the proxy and check for required credentials and instance
+	pError(loadSharedEnv())
+	t, err := loadTarget()
+	pError(err)
+	dbName, dbUser, dbPass := t.dbName, t.dbUser, t.dbPass
+
+	// Optional structured events in Cloud Logging, next to the console log
+	pError(startCloudLogging(os.Getenv("CLOUD_LOGGING_LOG_NAME"), t))
+
+	// Optional overrides for the summary and exit code when nothing was applied
+	noChangeText := os.Getenv("NOCHANGE_MESSAGE")
+	if len(noChangeText) == 0 {
+		noChangeText = NoChangeMessage
 	}
-	if len(dbUser) == 0 {
-		pError(errors.New("Missing required env, DB_PASS"))
+	noChangeMessage, err := parseNoChangeMessage(noChangeText)
+	pError(err)
+	noChangeExitCode := 0
+	if code := os.Getenv("NOCHANGE_EXIT_CODE"); len(code) > 0 {
+		noChangeExitCode, err = strconv.Atoi(code)
+		if err != nil {
+			pError(fmt.Errorf("Invalid NOCHANGE_EXIT_CODE %q: %+v", code, err))
+		}
 	}
 
-	// Step 3: Load up the proxy with the instance and credentials
-	instanceArg := fmt.Sprintf("-instances=%s=tcp:%d", instanceID, SQLCloudProxyPort)
-	fmt.Println("Instance args: ", instanceArg)
-	args := []string{instanceArg}
+	// Who triggered this run and as part of which deploy, for auditing
+	operator, deployID, err := runIdentity(os.Getenv("OPERATOR"), os.Getenv("DEPLOY_ID"))
+	pError(err)
+	logf("Running migrations as operator %q for deploy %q\n", operator, deployID)
+
+	// Optional redo of the latest migrations, a dev-loop convenience
+	redoLast := 0
+	if redo := os.Getenv("REDO_LAST"); len(redo) > 0 {
+		if redo == "true" {
+			redo = "1"
+		}
+		redoLast, err = strconv.Atoi(redo)
+		if err != nil || redoLast < 1 {
+			pError(fmt.Errorf("Invalid REDO_LAST %q, expected a positive number of migrations", redo))
+		}
 
-	// Build out the cmd
-	outBuff := new(bytes.Buffer)
-	proxyCMD = exec.Command(path, args...)
-	proxyCMD.Stderr = os.Stderr
-	proxyCMD.Stderr = outBuff
+		pattern := os.Getenv("PRODUCTION_DB_PATTERN")
+		if len(pattern) == 0 {
+			pattern = ProductionDBPattern
+		}
+		prodRe, err := regexp.Compile(pattern)
+		if err != nil {
+			pError(fmt.Errorf("Invalid PRODUCTION_DB_PATTERN %q: %+v", pattern, err))
+		}
+		if prodRe.MatchString(dbName) && os.Getenv("CONFIRM_REDO") != "yes" {
+			pError(fmt.Errorf("Refusing to redo migrations on %q which looks like a production database, set CONFIRM_REDO=yes to continue", dbName))
+		}
+	}
 
-	// Add ENVs
-	osENVs := os.Environ()
-	proxyCMD.Env = osENVs
+	// Optional retry budget shared by all phases of the run
+	budget, err := newRetryBudget(os.Getenv("RUN_RETRY_BUDGET"), os.Getenv("RUN_RETRY_WINDOW"))
+	pError(err)
+
+	// Registered first so it runs last, once the lock, heartbeat and proxy are cleaned up
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			syncLogs()
+			os.Exit(exitCode)
+		}
+	}()
 
 	// Exec the application
 	defer func() {
@@ -87,91 +228,241 @@ func main() {
 	}()
 	trapKillForCleanup()
 
-	// Start the process
-	if err := proxyCMD.Start(); err != nil {
-		fmt.Println("Child process exited with error: ", err)
+	// Step 3: Load up the proxy with the instance and credentials
+	pError(t.startProxy(budget))
+	proxyCMD, proxyDone = t.cmd, t.done
+	cloudLog.event("INFO", "proxy-ready", "Cloud SQL proxy is ready", nil)
+
+	// Optional shell step once the tunnel is up
+	if onReady := os.Getenv("ON_READY_COMMAND"); len(onReady) > 0 {
+		pError(runOnReadyCommand(onReady, dbUser, dbPass, dbName))
+	}
+
+	// Proxy is setup, let's attempt the migrations
+	db, err := t.openDB(budget)
+	pError(err)
+	pError(checkTargetDatabase(db, dbName))
+	if keepaliveInterval > 0 {
+		defer startHeartbeat(db, keepaliveInterval)()
+	}
+
+	// Record what we run against, to correlate odd outcomes with versions later
+	proxyVer := proxyVersion(t.proxyPath)
+	serverVer, err := serverVersion(db)
+	pError(err)
+	logf("Running against proxy %q, server %q with migrator %s\n", proxyVer, serverVer, version)
+
+	// Refuse servers too old for the migrations' syntax
+	if minVersion := os.Getenv("MIN_SERVER_VERSION"); len(minVersion) > 0 && os.Getenv("SKIP_VERSION_CHECK") != "true" {
+		pError(checkServerVersion(db, minVersion))
+	}
+
+	// Refuse replicas before the first write fails cryptically
+	if os.Getenv("SKIP_READONLY_CHECK") != "true" {
+		pError(checkWritable(db))
+	}
+
+	// Build driver
+	migrations, err := migrationSource()
+	pError(err)
+
+	// Refuse migrations that aren't exactly what was signed
+	pError(verifyMigrationsFromEnv(migrations))
+
+	// Optional external lint of the migration files
+	if validator := os.Getenv("MIGRATION_VALIDATOR_CMD"); len(strings.TrimSpace(validator)) > 0 {
+		pError(runValidatorCommand(validator, migrations))
+	}
+	if os.Getenv("REQUIRE_DOWN") == "true" {
+		pError(checkDownSections(migrations))
+	}
+
+	// Take turns with other migrators, e.g. pods of a scaled deploy
+	var lock *migrationLock
+	if useAdvisoryLock() {
+		retries, waitTimeout, err := lockSettings()
 		pError(err)
+		lock, err = acquireMigrationLock(db, trackingTableLabel(), retries, waitTimeout)
+		pError(err)
+		defer func() {
+			if err := lock.release(); err != nil {
+				logln("Warning: ", err)
+			}
+		}()
+	}
+
+	// Optionally wait for another system's signal, e.g. its own schema lock
+	if query := os.Getenv("WAIT_FOR_QUERY"); len(query) > 0 {
+		pError(waitForQuery(db, query, os.Getenv("WAIT_FOR_TIMEOUT")))
+	}
+
+	// Warn when the tracking table looks like it belongs to another app
+	pError(checkTrackingCollision(db, migrations))
+
+	// Catch renamed or deleted migration files before they confuse the plan
+	pError(checkTrackingDrift(db, migrations, os.Getenv("STRICT_TRACKING") == "true"))
+
+	// Applied migrations should be a prefix of the files, a gap means drift
+	pError(checkAppliedPrefix(db, migrations, os.Getenv("STRICT_PREFIX") == "true"))
+
+	if redoLast > 0 {
+		pError(redoMigrations(db, migrations, redoLast, applyOptions{lock: lock, events: cloudLog}))
+		return
+	}
+
+	// An explicit list of steps replaces the normal plan entirely
+	if plan := os.Getenv("MIGRATION_PLAN"); len(plan) > 0 {
+		pError(runMigrationPlan(db, migrations, plan))
+		return
+	}
+
+	if os.Getenv("ALLOW_TRACKING_TABLE_MODIFICATION") != "yes" {
+		pError(checkTrackingTableUntouched(db, migrations, trackingTable))
 	}
 
-	// Dispatch GoRoutine for executing the process
-	waitCh := make(chan error, 1)
-	go func(cmd *exec.Cmd) {
-		err := proxyCMD.Wait()
-		pError(fmt.Errorf("Could not start cloud SQL Proxy with error: %+v", err))
-		waitCh <- err
-	}(proxyCMD)
+	// Show the structural effect of the pending migrations without keeping it
+	if os.Getenv("SCHEMA_DIFF") == "true" {
+		pError(printSchemaDiff(db, migrations))
+		return
+	}
+
+	// Remember what was already applied so we can report it as skipped
+	before, err := appliedMigrationIDs(db)
+	pError(err)
 
-	// Timeout the waiting of the proxy to get up
-	proxyIsUp := new(bool)
-	go func() {
-		time.Sleep(10 * time.Second)
-		if !*proxyIsUp {
-			proxyCMD.Process.Kill()
-			pError(errors.New("Proxy setup timed out"))
+	// Escape valve for a known bad migration, short of deleting the file
+	var excluded []string
+	if skip := parseList(os.Getenv("SKIP_MIGRATIONS")); len(skip) > 0 {
+		if os.Getenv("CONFIRM_SKIP") != "yes" {
+			pError(errors.New("Refusing to skip SKIP_MIGRATIONS without confirmation, skipping can leave gaps in the schema. Set CONFIRM_SKIP=yes to continue"))
 		}
-	}()
+		excluded, err = skipPending(migrations, skip, before)
+		pError(err)
+	}
 
-	// Scan the output to listen for a successful connection
-	for {
-		bytez, err := outBuff.ReadBytes('\n')
-		if err != nil && err != io.EOF {
-			pError(err)
+	// Make it obvious when we continue a set that's already partly applied
+	lastApplied, pending, err := lastAppliedMigration(db, migrations, before)
+	pError(err)
+	if len(lastApplied) > 0 && pending > 0 {
+		logf("Resuming after %s, %d migrations pending\n", lastApplied, pending)
+		if os.Getenv("RESUME_REQUIRES_CONFIRMATION") == "true" && os.Getenv("CONFIRM_RESUME") != "yes" {
+			pError(fmt.Errorf("Refusing to resume after %s without confirmation, a previous run may have left the data in an unexpected state. Set CONFIRM_RESUME=yes to continue", lastApplied))
 		}
+	}
+
+	// Catch stub migrations before they are recorded as applied
+	pError(checkEmptyMigrations(db, migrations, os.Getenv("FAIL_ON_EMPTY_MIGRATION") == "true"))
+
+	// Optionally make sure big index builds and rewrites have room to finish
+	if os.Getenv("DISK_PREFLIGHT") == "true" {
+		pError(checkDiskSpace(db, migrations, t.instanceID, os.Getenv("FAIL_ON_LOW_DISK") == "true"))
+	}
 
-		if len(bytez) > 0 {
-			fmt.Println("SQL Logs: ", string(bytez))
-			if strings.Contains(string(bytez), "Ready for new connections") {
-				*proxyIsUp = true
-				break
+	// Optional dress rehearsal on a clone, after every check of the migrations.
+	// Blockers are only handled after it, so none come back during a long rehearsal
+	if clone := os.Getenv("SHADOW_CLONE_INSTANCE"); len(clone) > 0 {
+		pError(runShadowApply(t, clone, budget, migrations))
+	}
+
+	// Optionally deal with sessions that would block exclusive locks
+	if os.Getenv("TERMINATE_BLOCKERS") == "true" {
+		minDuration := DefaultBlockerMinDuration
+		if d := os.Getenv("BLOCKER_MIN_DURATION"); len(d) > 0 {
+			minDuration, err = time.ParseDuration(d)
+			if err != nil {
+				pError(fmt.Errorf("Invalid BLOCKER_MIN_DURATION %q: %+v", d, err))
 			}
 		}
-		time.Sleep(500 * time.Millisecond)
+		terminate := os.Getenv("CONFIRM_TERMINATE_BLOCKERS") == "yes"
+		pError(handleLockBlockers(db, dbName, minDuration, terminate))
 	}
 
-	// Ensure migrations folder
-	path, err = os.Getwd()
-	if _, err := os.Stat(MigrationsFolder); err != nil {
-		pError(errors.New("Migrations folder missing"))
+	// Remember indexes that were already invalid so we only flag our own
+	invalidBefore, err := invalidIndexes(db)
+	pError(err)
+
+	logln("About to execute migrations: ")
+	n := 0
+	// Only a dropped connection is retried, a SQL error would just fail again
+	pError(budget.runRetryable("Migration", isRetryableApplyError, func() error {
+		applied, err := applyMigrations(db, migrations, migrate.Up, 0, applyOptions{lock: lock, events: cloudLog, timings: &appliedTimings})
+		n += applied
+		return err
+	}))
+
+	if lock != nil && lock.Waited && n == 0 {
+		logln("Nothing left to apply after waiting for the migration lock, another migrator did the work")
+	} else if lock != nil && lock.Waited {
+		logf("This migrator applied %d migrations after waiting for the migration lock\n", n)
 	}
 
-	// Proxy is setup, let's attempt the migrations
-	pgURL := fmt.Sprintf("postgres://%s:%s@localhost:%d/%s?sslmode=disable", dbUser, dbPass, SQLCloudProxyPort, dbName)
-	fmt.Println("Attempting to open sql connection with url: ", pgURL)
-	db, err := sql.Open("postgres", pgURL)
-	pError(err)
+	pError(checkInvalidIndexes(db, invalidBefore))
 
-	// Build driver
-	migrations := &migrate.FileMigrationSource{
-		Dir: MigrationsFolder,
+	// Make sure the app's own, possibly lower privileged, role still works
+	if appDSN := os.Getenv("APP_HEALTHCHECK_DSN"); len(appDSN) > 0 {
+		pError(checkAppHealth(appDSN, os.Getenv("APP_HEALTHCHECK_QUERY")))
 	}
 
-	fmt.Println("About to execute migrations: ")
-	n, err := migrate.Exec(db, "postgres", migrations, migrate.Up)
+	summary := &runSummary{
+		Applied:       n,
+		Operator:      operator,
+		DeployID:      deployID,
+		Release:       os.Getenv("RELEASE_VERSION"),
+		ProxyVersion:  proxyVer,
+		ServerVersion: serverVer,
+		ToolVersion:   version,
+		ExcludedIDs:   excluded,
+	}
+	summary.AppliedIDs, summary.SkippedIDs, err = diffMigrationIDs(db, migrations, before)
 	pError(err)
-	fmt.Printf("Applied %d migrations!\n", n)
-}
+	logln("Skipped already applied migrations: ", strings.Join(summary.SkippedIDs, ", "))
+	logln("Applied migrations: ", strings.Join(summary.AppliedIDs, ", "))
+	if len(excluded) > 0 {
+		logln("Deliberately skipped migrations (SKIP_MIGRATIONS): ", strings.Join(excluded, ", "))
+	}
 
-func checkForProxy() (string, error) {
-	// Check for the binary in the same folder
-	files, err := ioutil.ReadDir("./")
-	if err != nil {
-		return "", err
+	// Optionally refresh the planner statistics the migrations made stale
+	if n > 0 {
+		pError(analyzeAfterMigrate(db, migrations, summary.AppliedIDs, os.Getenv("POST_MIGRATE_ANALYZE"), os.Getenv("POST_MIGRATE_ANALYZE_FALLBACK")))
 	}
 
-	// Try to find the binary locally
-	for _, f := range files {
-		if f.Name() == SQLCloudProxyBinary {
-			localPath := fmt.Sprintf("./%s", SQLCloudProxyBinary)
-			return localPath, nil
+	// Optional release stamp, to answer which schema changes shipped in a release
+	pError(recordRelease(db, summary.Release, operator, deployID, summary.AppliedIDs))
+
+	// Optional timing history, for spotting migrations that got slower
+	pError(recordTimings(db, os.Getenv("MIGRATION_TIMINGS_TABLE"), os.Getenv("MIGRATION_TIMINGS_FILE"), os.Getenv("ENVIRONMENT")))
+
+	pError(summary.write(os.Getenv("SUMMARY_FILE")))
+	cloudLog.event("INFO", "result", fmt.Sprintf("Applied %d migrations", n), map[string]interface{}{"status": "succeeded", "summary": summary})
+
+	// Optional metrics for the node exporter's textfile collector
+	pError(writeMetricsTextfile(os.Getenv("METRICS_TEXTFILE"), n, time.Since(runStart), time.Now()))
+
+	if schemaDumpFile := os.Getenv("SCHEMA_DUMP_FILE"); len(schemaDumpFile) > 0 {
+		err := dumpSchema(schemaDumpFile, dbUser, dbPass, dbName)
+		if err != nil && os.Getenv("SCHEMA_DUMP_REQUIRED") == "true" {
+			pError(err)
+		} else if err != nil {
+			logln("Warning, could not dump schema: ", err)
 		}
 	}
 
-	// Fall back to searching PATH
-	binary, lookErr := exec.LookPath(SQLCloudProxyBinary)
-	if lookErr != nil {
-		return "", errors.New("Invalid binary. Not in path")
+	if n == 0 {
+		message, err := summary.message(noChangeMessage)
+		pError(err)
+		logln(message)
+		if os.Getenv("TERMINATION_LOG_ON_SUCCESS") == "true" {
+			writeTerminationLog(message)
+		}
+		// Exits through the deferred cleanup above
+		exitCode = noChangeExitCode
+		return
+	}
+	message := fmt.Sprintf("Applied %d migrations!", n)
+	logln(message)
+	if os.Getenv("TERMINATION_LOG_ON_SUCCESS") == "true" {
+		writeTerminationLog(message)
 	}
-	return binary, nil
 }
 
 func currentFilePath() string {
@@ -180,38 +471,386 @@ func currentFilePath() string {
 	return filepath.Dir(ex)
 }
 
-func trapKillForCleanup() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	signal.Notify(c, os.Kill)
-	go func() {
-		for range c {
-			if proxyCMD != nil && proxyCMD.Process != nil {
-				proxyCMD.Process.Kill()
-			}
-		}
-	}()
+// Exit codes that let a pipeline tell proxy problems apart from other failures
+const (
+	ExitProxyStartFailed = 3
+	ExitProxyMissing     = 7
+)
+
+// exitError is a failure with its own exit code instead of log.Fatal's 1
+type exitError struct {
+	code int
+	err  error
 }
 
+func (e *exitError) Error() string { return e.err.Error() }
+
+func (e *exitError) Unwrap() error { return e.err }
+
 func pError(err error) {
 	if err != nil {
-		fmt.Printf("Exiting with error: %+v\n", err)
+		logf("Exiting with error: %+v\n", err)
+		cloudLog.event("ERROR", "result", "Migrations failed", map[string]interface{}{"status": "failed", "error": err.Error()})
+		writeTerminationLog(fmt.Sprintf("Migrations failed: %+v", err))
 		ensureProcessKill(proxyCMD)
+		syncLogs()
+		var coded *exitError
+		if errors.As(err, &coded) {
+			log.Print(err)
+			os.Exit(coded.code)
+		}
 		log.Fatal(err)
 	}
 }
 
-// Ensuring we're killing our child process
-func ensureProcessKill(cmdProcess *exec.Cmd) error {
-	if cmdProcess != nil {
-		// Try the normal way
-		cmdProcess.Process.Kill()
+// writeTerminationLog leaves a short message for `kubectl describe pod`. The
+// default path is only written when it exists, which it does inside Kubernetes
+func writeTerminationLog(msg string) {
+	path := os.Getenv("TERMINATION_LOG_PATH")
+	if len(path) == 0 {
+		path = TerminationLogPath
+		if _, err := os.Stat(path); err != nil {
+			return
+		}
+	}
+
+	msg = truncateUTF8(msg, TerminationLogMaxBytes)
+	if err := ioutil.WriteFile(path, []byte(msg), 0644); err != nil {
+		logln("Could not write termination log: ", err)
+	}
+}
 
-		// Sometimes go doesn't kill the process. Lets send a sig 9
-		pgid, err := syscall.Getpgid(cmdProcess.Process.Pid)
-		if err == nil {
-			syscall.Kill(-pgid, 9)
+// truncateUTF8 cuts s to at most max bytes without splitting a rune
+func truncateUTF8(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// loadSharedEnv reads the settings every command that touches the database uses
+func loadSharedEnv() error {
+	// Fail on a bad CA_CERT_FILE now rather than at the first API call
+	if _, err := outboundHTTPClient(); err != nil {
+		return err
+	}
+
+	// Optional bound on how long teardown waits for the proxy
+	if timeout := os.Getenv("KILL_TIMEOUT"); len(timeout) > 0 {
+		var err error
+		killTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return fmt.Errorf("Invalid KILL_TIMEOUT %q: %+v", timeout, err)
 		}
 	}
+
+	// Optional bound on how long a single migration may run
+	if timeout := os.Getenv("PER_MIGRATION_TIMEOUT"); len(timeout) > 0 {
+		var err error
+		perMigrationTimeout, err = time.ParseDuration(timeout)
+		if err != nil || perMigrationTimeout < 0 {
+			return fmt.Errorf("Invalid PER_MIGRATION_TIMEOUT %q, expected a duration like 10m", timeout)
+		}
+	}
+
+	// Optional transaction pooling mode, which rules out session level features
+	switch mode := os.Getenv("PGBOUNCER_MODE"); mode {
+	case "":
+	case "transaction":
+		pgbouncerTransactionMode = true
+		logln("PGBOUNCER_MODE=transaction, the advisory lock is disabled and parameters are sent without server side prepares")
+		for _, name := range []string{"LOCK_ACQUIRE_RETRIES", "LOCK_WAIT_TIMEOUT", "DRY_RUN_WITH_LOCK"} {
+			if len(os.Getenv(name)) > 0 {
+				logf("Warning, %s has no effect under PGBOUNCER_MODE=transaction, there is no advisory lock\n", name)
+			}
+		}
+	default:
+		return fmt.Errorf("Invalid PGBOUNCER_MODE %q, expected transaction", mode)
+	}
+
+	// Optional keepalive for multi-hour runs with idle gaps
+	if interval := os.Getenv("CONN_KEEPALIVE_INTERVAL"); len(interval) > 0 {
+		var err error
+		keepaliveInterval, err = time.ParseDuration(interval)
+		if err != nil || keepaliveInterval <= 0 {
+			return fmt.Errorf("Invalid CONN_KEEPALIVE_INTERVAL %q, expected a duration like 30s", interval)
+		}
+	}
+
+	// Optional bound on pings and heartbeats, for half-open connections
+	if timeout := os.Getenv("PING_TIMEOUT"); len(timeout) > 0 {
+		var err error
+		pingTimeout, err = time.ParseDuration(timeout)
+		if err != nil || pingTimeout <= 0 {
+			return fmt.Errorf("Invalid PING_TIMEOUT %q, expected a duration like 3s", timeout)
+		}
+	}
+
+	// Optional ping retries between migrations, for proxy reconnects during long runs
+	if retries := os.Getenv("RECONNECT_RETRIES"); len(retries) > 0 {
+		var err error
+		reconnectRetries, err = strconv.Atoi(retries)
+		if err != nil || reconnectRetries < 0 {
+			return fmt.Errorf("Invalid RECONNECT_RETRIES %q, expected a number of retries", retries)
+		}
+	}
+
+	// Optional Admin API endpoint, e.g. inside a VPC Service Controls perimeter
+	if endpoint := os.Getenv("SQLADMIN_ENDPOINT"); len(endpoint) > 0 {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+			return fmt.Errorf("Invalid SQLADMIN_ENDPOINT %q, expected a URL like https://sqladmin.googleapis.com/", endpoint)
+		}
+		sqladminEndpoint = endpoint
+	}
+
+	failOnWarning = os.Getenv("FAIL_ON_WARNING") == "true"
+
+	// Optional SQLSTATEs tolerated for idempotent DDL, off unless listed
+	for _, code := range parseList(os.Getenv("IGNORE_SQLSTATES")) {
+		if !sqlStatePattern.MatchString(code) {
+			return fmt.Errorf("Invalid SQLSTATE %q in IGNORE_SQLSTATES, expected five characters like 42P07", code)
+		}
+		ignoredSQLStates[strings.ToUpper(code)] = true
+	}
+
+	// Optional tracking table override
+	if table := os.Getenv("MIGRATIONS_TABLE"); len(table) > 0 {
+		trackingTable = table
+	}
+	migrate.SetTable(trackingTable)
+	trackingSchema = os.Getenv("DB_SCHEMA")
+	migrate.SetSchema(trackingSchema)
 	return nil
 }
+
+// trackingTableName is the tracking table as written in SQL, schema qualified under DB_SCHEMA
+func trackingTableName() string {
+	if len(trackingSchema) == 0 {
+		return pq.QuoteIdentifier(trackingTable)
+	}
+	return pq.QuoteIdentifier(trackingSchema) + "." + pq.QuoteIdentifier(trackingTable)
+}
+
+// trackingTableLabel is the unquoted tracking table for messages and the lock key
+func trackingTableLabel() string {
+	if len(trackingSchema) == 0 {
+		return trackingTable
+	}
+	return trackingSchema + "." + trackingTable
+}
+
+// target is the database we migrate and how to reach it through the proxy
+type target struct {
+	proxyPath  string
+	instanceID string
+	port       int
+	dbName     string
+	dbUser     string
+	dbPass     string
+	pgURL      string
+
+	// The running proxy and its exit channel, once startProxy succeeded
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// loadTarget finds the proxy binary and reads the required connection env
+func loadTarget() (*target, error) {
+	if err := requireNetwork("connecting to the database through the proxy"); err != nil {
+		return nil, err
+	}
+
+	// Check for proxy in path, find executable path
+	path, err := checkForProxy()
+	if err != nil {
+		return nil, err
+	}
+
+	// Check for required credentials file and instance identifier
+	creds := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	t := &target{
+		proxyPath:  path,
+		instanceID: os.Getenv("SQL_INSTANCE_ID"),
+		port:       SQLCloudProxyPort,
+		dbName:     os.Getenv("DB_NAME"),
+		dbPass:     os.Getenv("DB_PASS"),
+		dbUser:     os.Getenv("DB_USER"),
+	}
+	if len(creds) == 0 {
+		return nil, errors.New("Missing required env, GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if len(t.instanceID) == 0 {
+		logln("SQL_INSTANCE_ID not set, looking up instances in the credentials' project")
+		t.instanceID, err = discoverInstance(os.Getenv("INSTANCE_NAME_FILTER"))
+		if err != nil {
+			return nil, err
+		}
+		logln("Using discovered instance: ", t.instanceID)
+	}
+	if len(t.dbName) == 0 {
+		return nil, errors.New("Missing required env, DB_NAME")
+	}
+	if len(t.dbPass) == 0 {
+		return nil, errors.New("Missing required env, DB_PASS")
+	}
+	if len(t.dbUser) == 0 {
+		return nil, errors.New("Missing required env, DB_USER")
+	}
+
+	t.pgURL = proxyDSN(t.dbUser, t.dbPass, t.dbName, t.port)
+	return t, nil
+}
+
+// proxyDSN is the URL of the database through the proxy on port, with the user,
+// password and database name escaped so dashes, spaces and the like survive
+func proxyDSN(user, pass, dbName string, port int) string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(user, pass),
+		Host:     fmt.Sprintf("localhost:%d", port),
+		Path:     "/" + dbName,
+		RawQuery: "sslmode=disable",
+	}
+	// Skip the separate prepare round trip, a pooler may route it to another server connection
+	if pgbouncerTransactionMode {
+		u.RawQuery += "&binary_parameters=yes"
+	}
+	return u.String()
+}
+
+// redactedDSN hides the password of a DSN for logging. Anything but a
+// postgres:// URL with a host, like a key/value DSN, is masked entirely, a
+// password in it can't be told apart reliably
+func redactedDSN(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") || len(u.Host) == 0 {
+		return "(redacted)"
+	}
+	if q := u.Query(); len(q.Get("password")) > 0 {
+		q.Set("password", "xxxxx")
+		u.RawQuery = q.Encode()
+	}
+	return u.Redacted()
+}
+
+// startProxy brings up the tunnel, refusing to run next to a leftover proxy
+func (t *target) startProxy(budget *retryBudget) error {
+	// Make sure a leftover proxy isn't already serving our port
+	if err := checkProxyPortFree(t.pgURL, t.port); err != nil {
+		return err
+	}
+
+	err := budget.run("Proxy start", func() error {
+		var err error
+		t.cmd, t.done, err = startProxy(t.proxyPath, t.instanceID, t.port)
+		return err
+	})
+	if err != nil {
+		return &exitError{code: ExitProxyStartFailed, err: err}
+	}
+	return nil
+}
+
+// stopProxy kills the target's proxy, if it runs
+func (t *target) stopProxy() {
+	killProxy(t.cmd, t.done)
+	t.cmd, t.done = nil, nil
+}
+
+// openDB connects to the database through the running proxy
+func (t *target) openDB(budget *retryBudget) (*sql.DB, error) {
+	logln("Attempting to open sql connection with url: ", redactedDSN(t.pgURL))
+	var db *sql.DB
+	err := budget.run("Database connect", func() error {
+		connector, err := pq.NewConnector(t.pgURL)
+		if err != nil {
+			return err
+		}
+		if keepaliveInterval > 0 {
+			connector.Dialer(&keepaliveDialer{net.Dialer{KeepAlive: keepaliveInterval}})
+		}
+		// Surface RAISE NOTICE and warnings from the migrations
+		db = sql.OpenDB(pq.ConnectorWithNoticeHandler(connector, logNotice))
+		if err := pingDB(db); err != nil {
+			db.Close()
+			return err
+		}
+		return nil
+	})
+	return db, err
+}
+
+// migrationsPath is MIGRATIONS_DIR, or the local migrations folder when unset
+func migrationsPath() string {
+	if dir := os.Getenv("MIGRATIONS_DIR"); len(dir) > 0 {
+		return dir
+	}
+	return MigrationsFolder
+}
+
+// migrationSource builds the migration source for the migrations folder, or a
+// single migration file, and makes sure it holds at least one migration
+func migrationSource() (*extensionMigrationSource, error) {
+	extensions := parseList(os.Getenv("MIGRATION_EXTENSIONS"))
+	if len(extensions) == 0 {
+		extensions = []string{DefaultMigrationExtension}
+	}
+	path := migrationsPath()
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.New("Migrations folder missing")
+	}
+
+	source := &extensionMigrationSource{
+		Dir:        path,
+		Extensions: extensions,
+		Stream:     os.Getenv("STREAM_LARGE_MIGRATIONS") == "true",
+	}
+	if !info.IsDir() {
+		// Single file mode, the file name is the id so tracking applies it once
+		source.Dir, source.File = filepath.Dir(path), filepath.Base(path)
+		file, err := os.Open(path)
+		if err == nil {
+			file.Close()
+		}
+		if err != nil || !info.Mode().IsRegular() || !source.hasExtension(source.File) {
+			return nil, fmt.Errorf("MIGRATIONS_DIR %s is neither a directory nor a readable %s file", path, strings.Join(extensions, ", "))
+		}
+	}
+	if maxMB := os.Getenv("MAX_MIGRATION_FILE_MB"); len(maxMB) > 0 {
+		mb, err := strconv.ParseInt(maxMB, 10, 64)
+		if err != nil || mb < 0 {
+			return nil, fmt.Errorf("Invalid MAX_MIGRATION_FILE_MB %q, expected a size in megabytes", maxMB)
+		}
+		source.MaxFileBytes = mb * 1024 * 1024
+	}
+	if err := source.checkReadable(); err != nil {
+		return nil, err
+	}
+	found, err := source.FindMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("No migrations with extensions %s found in %s", strings.Join(extensions, ", "), path)
+	}
+	if err := checkDuplicateVersions(found); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// parseList splits a comma separated env value, dropping empty entries
+func parseList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// migrationsManifest lists the sha256 of every migration file, sorted by
+// name, in sha256sum's "HASH  NAME" format, which is what gets signed
+func migrationsManifest(source *extensionMigrationSource) ([]byte, error) {
+	files, err := source.Files()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var b bytes.Buffer
+	for _, name := range files {
+		sum, err := fileSHA256(filepath.Join(source.Dir, name))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&b, "%s  %s\n", sum, name)
+	}
+	return b.Bytes(), nil
+}
+
+// fileSHA256 hashes a file as it is read, so large migrations aren't loaded whole
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyMigrationsSignature refuses to run unless the migration files match
+// the manifest signed with the ed25519 MIGRATIONS_PUBKEY. The signed manifest
+// is MIGRATIONS_MANIFEST when shipped, which names the files that differ,
+// otherwise the one computed from the folder
+func verifyMigrationsSignature(source *extensionMigrationSource, signaturePath, keyPath, manifestPath string) error {
+	if len(signaturePath) == 0 && len(keyPath) == 0 {
+		return nil
+	}
+	if len(signaturePath) == 0 || len(keyPath) == 0 {
+		return errors.New("MIGRATIONS_SIGNATURE and MIGRATIONS_PUBKEY must be set together")
+	}
+
+	key, err := loadPublicKey(keyPath)
+	if err != nil {
+		return err
+	}
+	signature, err := readDecoded(signaturePath, ed25519.SignatureSize)
+	if err != nil {
+		return fmt.Errorf("Could not read MIGRATIONS_SIGNATURE: %+v", err)
+	}
+	actual, err := migrationsManifest(source)
+	if err != nil {
+		return fmt.Errorf("Could not hash the migration files: %+v", err)
+	}
+
+	signed := actual
+	if len(manifestPath) > 0 {
+		if signed, err = ioutil.ReadFile(manifestPath); err != nil {
+			return fmt.Errorf("Could not read MIGRATIONS_MANIFEST: %+v", err)
+		}
+	}
+	if !ed25519.Verify(key, signed, signature) {
+		return errors.New("Invalid MIGRATIONS_SIGNATURE, the migrations don't match what was signed. Refusing to run")
+	}
+	if !bytes.Equal(signed, actual) {
+		return fmt.Errorf("Migration files don't match the signed manifest, refusing to run: %s", strings.Join(manifestDifferences(signed, actual), "; "))
+	}
+	logln("Migration files match the signed manifest")
+	return nil
+}
+
+// manifestDifferences names the files added, removed or changed between manifests
+func manifestDifferences(signed, actual []byte) []string {
+	parse := func(manifest []byte) map[string]string {
+		hashes := map[string]string{}
+		for _, line := range strings.Split(string(manifest), "\n") {
+			if fields := strings.SplitN(line, "  ", 2); len(fields) == 2 {
+				hashes[fields[1]] = fields[0]
+			}
+		}
+		return hashes
+	}
+	want, got := parse(signed), parse(actual)
+
+	var diffs []string
+	for name, hash := range want {
+		if gotHash, ok := got[name]; !ok {
+			diffs = append(diffs, name+" is missing")
+		} else if gotHash != hash {
+			diffs = append(diffs, name+" was modified")
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			diffs = append(diffs, name+" is not in the manifest")
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// loadPublicKey reads an ed25519 public key, PEM encoded as openssl writes it,
+// or as the raw 32 bytes, base64 encoded or not
+func loadPublicKey(path string) (ed25519.PublicKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read MIGRATIONS_PUBKEY: %+v", err)
+	}
+	if block, _ := pem.Decode(content); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid MIGRATIONS_PUBKEY: %+v", err)
+		}
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("Invalid MIGRATIONS_PUBKEY, expected an ed25519 key")
+		}
+		return edKey, nil
+	}
+
+	raw, err := readDecoded(path, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid MIGRATIONS_PUBKEY: %+v", err)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// readDecoded reads a file holding size raw bytes, or those bytes base64 encoded
+func readDecoded(path string, size int) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) == size {
+		return content, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(decoded) != size {
+		return nil, fmt.Errorf("%s should hold %d bytes, raw or base64 encoded", path, size)
+	}
+	return decoded, nil
+}
+
+// verifyMigrationsFromEnv checks the signature configured in the environment, if any
+func verifyMigrationsFromEnv(source *extensionMigrationSource) error {
+	return verifyMigrationsSignature(source, os.Getenv("MIGRATIONS_SIGNATURE"), os.Getenv("MIGRATIONS_PUBKEY"), os.Getenv("MIGRATIONS_MANIFEST"))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// writeMetricsTextfile writes the metrics of a successful run in Prometheus
+// text exposition format for the node exporter's textfile collector. The file
+// is replaced atomically so the collector never reads a partial one
+func writeMetricsTextfile(path string, applied int, duration time.Duration, finished time.Time) error {
+	if len(path) == 0 {
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintln(&b, "# HELP cloudsql_migration_last_success_timestamp Unix time of the last successful migration run.")
+	fmt.Fprintln(&b, "# TYPE cloudsql_migration_last_success_timestamp gauge")
+	fmt.Fprintf(&b, "cloudsql_migration_last_success_timestamp %d\n", finished.Unix())
+	fmt.Fprintln(&b, "# HELP cloudsql_migrations_applied_last_run Migrations applied by the last successful run.")
+	fmt.Fprintln(&b, "# TYPE cloudsql_migrations_applied_last_run gauge")
+	fmt.Fprintf(&b, "cloudsql_migrations_applied_last_run %d\n", applied)
+	fmt.Fprintln(&b, "# HELP cloudsql_migration_duration_seconds Duration of the last successful migration run.")
+	fmt.Fprintln(&b, "# TYPE cloudsql_migration_duration_seconds gauge")
+	fmt.Fprintf(&b, "cloudsql_migration_duration_seconds %g\n", duration.Seconds())
+
+	// The temp file sits next to the target so the rename stays on one filesystem
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return fmt.Errorf("Could not write METRICS_TEXTFILE: %+v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Could not write METRICS_TEXTFILE: %+v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Could not write METRICS_TEXTFILE: %+v", err)
+	}
+	// The collector runs as another user, TempFile creates the file 0600
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("Could not write METRICS_TEXTFILE: %+v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Could not write METRICS_TEXTFILE: %+v", err)
+	}
+	logln("Wrote metrics to: ", path)
+	return nil
+}
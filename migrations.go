@@ -0,0 +1,843 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rubenv/sql-migrate"
+)
+
+// extensionMigrationSource reads migrations from a folder like
+// migrate.FileMigrationSource, but for a configurable list of file extensions
+type extensionMigrationSource struct {
+	Dir        string
+	Extensions []string
+
+	// MaxFileBytes caps the size of a migration file loaded into memory, 0 for no cap
+	MaxFileBytes int64
+
+	// Stream executes files over the cap statement by statement instead of failing
+	Stream bool
+
+	// File limits the source to this one file in Dir, skipping the folder scan
+	File string
+
+	// Skip leaves these ids out of the migrations, see SKIP_MIGRATIONS
+	Skip map[string]bool
+}
+
+var _ migrate.MigrationSource = (*extensionMigrationSource)(nil)
+
+// FindMigrations parses every file with a known extension, sorted by id
+func (s extensionMigrationSource) FindMigrations() ([]*migrate.Migration, error) {
+	files, err := s.Files()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []*migrate.Migration
+	for _, name := range files {
+		if s.Skip[name] {
+			continue
+		}
+		tooBig, err := s.overSizeCap(name)
+		if err != nil {
+			return nil, err
+		}
+		if tooBig && !s.Stream {
+			return nil, fmt.Errorf("Migration %s is larger than MAX_MIGRATION_FILE_MB=%d, set STREAM_LARGE_MIGRATIONS=true to stream it", name, s.MaxFileBytes/(1024*1024))
+		}
+		if tooBig {
+			// Only the options are read here, the statements are streamed when applied
+			m, err := scanStreamedMigration(name, filepath.Join(s.Dir, name))
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, m)
+			continue
+		}
+
+		file, err := os.Open(filepath.Join(s.Dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("Error while opening %s: %+v", name, err)
+		}
+		m, err := migrate.ParseMigration(name, file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Error while parsing %s: %+v", name, err)
+		}
+		found = append(found, m)
+	}
+
+	// Let sql-migrate sort them the same way it sorts its own sources
+	return migrate.MemoryMigrationSource{Migrations: found}.FindMigrations()
+}
+
+// Files lists the names of the migration files in the folder
+func (s extensionMigrationSource) Files() ([]string, error) {
+	if len(s.File) > 0 {
+		return []string{s.File}, nil
+	}
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && s.hasExtension(f.Name()) {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+// checkDuplicateVersions fails when two migration files share a version
+// number, a common leftover of merging two branches
+func checkDuplicateVersions(migrations []*migrate.Migration) error {
+	byVersion := map[int64][]string{}
+	var versions []int64
+	for _, m := range migrations {
+		if len(m.NumberPrefixMatches()) == 0 {
+			continue
+		}
+		v := m.VersionInt()
+		if len(byVersion[v]) == 0 {
+			versions = append(versions, v)
+		}
+		byVersion[v] = append(byVersion[v], m.Id)
+	}
+
+	var duplicates []string
+	for _, v := range versions {
+		if ids := byVersion[v]; len(ids) > 1 {
+			duplicates = append(duplicates, fmt.Sprintf("version %d: %s", v, strings.Join(ids, ", ")))
+		}
+	}
+	if len(duplicates) > 0 {
+		return fmt.Errorf("Several migrations share a version number, renumber them: %s", strings.Join(duplicates, "; "))
+	}
+	return nil
+}
+
+// checkReadable lists the folder and reads from one migration file, so a
+// permission problem after a volume mount fails upfront with the details
+func (s extensionMigrationSource) checkReadable() error {
+	files, err := s.Files()
+	if err != nil {
+		return permissionError(s.Dir, err)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	path := filepath.Join(s.Dir, files[0])
+	file, err := os.Open(path)
+	if err != nil {
+		return permissionError(path, err)
+	}
+	defer file.Close()
+	if _, err := file.Read(make([]byte, 1)); err != nil && err != io.EOF {
+		return permissionError(path, err)
+	}
+	return nil
+}
+
+// permissionError explains a failed read with the runtime identity and the file mode
+func permissionError(path string, err error) error {
+	mode := "unknown"
+	if info, statErr := os.Stat(path); statErr == nil {
+		mode = info.Mode().String()
+	}
+	return fmt.Errorf("Can't read %s (mode %s) as uid %d gid %d, check the ownership and permissions of the mount: %+v", path, mode, os.Getuid(), os.Getgid(), err)
+}
+
+// overSizeCap reports whether the migration file is larger than MaxFileBytes
+func (s extensionMigrationSource) overSizeCap(name string) (bool, error) {
+	if s.MaxFileBytes <= 0 {
+		return false, nil
+	}
+	info, err := os.Stat(filepath.Join(s.Dir, name))
+	if err != nil {
+		return false, err
+	}
+	return info.Size() > s.MaxFileBytes, nil
+}
+
+func (s extensionMigrationSource) hasExtension(name string) bool {
+	for _, ext := range s.Extensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyOptions is the state of the surrounding run that applyMigrations
+// keeps up or reports to, all optional
+type applyOptions struct {
+	// The advisory lock to hold on to across reconnects
+	lock *migrationLock
+
+	// Where migration-applied events go
+	events *cloudLogger
+
+	// Collects the timing of every migration applied up
+	timings *[]migrationTiming
+}
+
+// applyMigrations plans the migrations in a direction, at most max of them or
+// all for 0, and applies them one at a time
+func applyMigrations(db *sql.DB, source *extensionMigrationSource, dir migrate.MigrationDirection, max int, opts applyOptions) (int, error) {
+	planned, _, err := migrate.PlanMigration(db, "postgres", source, dir, max)
+	if err != nil {
+		return 0, err
+	}
+	return applyPlanned(db, source, planned, dir, opts)
+}
+
+// applyPlanned applies exactly the planned migrations in a direction, in order
+func applyPlanned(db *sql.DB, source *extensionMigrationSource, planned []*migrate.PlannedMigration, dir migrate.MigrationDirection, opts applyOptions) (int, error) {
+	applied := 0
+	for _, m := range planned {
+		if err := ensureConnection(db, opts.lock); err != nil {
+			return applied, err
+		}
+		start := time.Now()
+		if err := applyMigration(db, source, m, dir); err != nil {
+			if err = retryMigration(db, source, m, dir, opts.lock, err); err != nil {
+				if m.DisableTransaction {
+					err = &outsideTransactionError{err: err}
+				}
+				return applied, err
+			}
+		}
+		if dir == migrate.Up {
+			opts.events.event("INFO", "migration-applied", "Applied migration "+m.Id, map[string]interface{}{"id": m.Id, "duration_seconds": time.Since(start).Seconds()})
+			if opts.timings != nil {
+				*opts.timings = append(*opts.timings, migrationTiming{
+					ID:        m.Id,
+					Duration:  time.Since(start),
+					AppliedAt: start,
+				})
+			}
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// applyMigration runs one planned migration and updates the tracking table the
+// way sql-migrate does, inside a transaction unless the migration opts out.
+// Files over the size cap are streamed from disk instead of run from memory
+func applyMigration(db *sql.DB, source *extensionMigrationSource, m *migrate.PlannedMigration, dir migrate.MigrationDirection) error {
+	// Cancelling the context cancels the running statement on the server
+	ctx := context.Background()
+	if perMigrationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, perMigrationTimeout)
+		defer cancel()
+	}
+
+	var tx *sql.Tx
+	var executor sqlExecutor = contextExecutor{ctx: ctx, target: db}
+	if !m.DisableTransaction {
+		var err error
+		if tx, err = db.BeginTx(ctx, nil); err != nil {
+			return migrationError(ctx, m.Id, err)
+		}
+		executor = contextExecutor{ctx: ctx, target: tx}
+	}
+
+	// Statements may tolerate IGNORE_SQLSTATES, the tracking update may not
+	statements := executor
+	if len(ignoredSQLStates) > 0 {
+		statements = ignoringExecutor{id: m.Id, target: executor, inTx: tx != nil}
+	}
+
+	beginNotices(m.Id)
+	err := func() error {
+		streamed, err := source.overSizeCap(m.Id)
+		if err != nil {
+			return err
+		}
+		if streamed {
+			logln("Streaming large migration: ", m.Id)
+			err = streamMigration(statements, filepath.Join(source.Dir, m.Id), dir)
+		} else {
+			for _, stmt := range m.Queries {
+				if _, err = statements.Exec(trimStatement(stmt)); err != nil {
+					break
+				}
+			}
+		}
+		if noticeErr := endNotices(failOnWarning); err == nil {
+			err = noticeErr
+		}
+		if err != nil {
+			return err
+		}
+		return recordMigration(executor, m.Id, dir)
+	}()
+	if err != nil {
+		if tx != nil {
+			tx.Rollback()
+		}
+		return migrationError(ctx, m.Id, err)
+	}
+
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return migrationError(ctx, m.Id, err)
+		}
+	}
+	return nil
+}
+
+// migrationError explains a failure caused by PER_MIGRATION_TIMEOUT, which
+// otherwise only shows up as a cancelled statement
+func migrationError(ctx context.Context, id string, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Migration %s exceeded its per-migration timeout of %s: %+v", id, perMigrationTimeout, err)
+	}
+	return fmt.Errorf("Migration %s failed: %w", id, err)
+}
+
+// runMigrationPlan executes exactly the ordered "down:ID" / "up:ID" steps of
+// MIGRATION_PLAN, checking each against the tracking table before running it
+func runMigrationPlan(db *sql.DB, source *extensionMigrationSource, plan string) error {
+	all, err := source.FindMigrations()
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]*migrate.Migration, len(all))
+	for _, m := range all {
+		byID[m.Id] = m
+	}
+
+	// Make sure the whole plan makes sense before touching anything
+	type step struct {
+		dir       migrate.MigrationDirection
+		migration *migrate.Migration
+	}
+	var steps []step
+	for _, item := range parseList(plan) {
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid MIGRATION_PLAN step %q, expected down:ID or up:ID", item)
+		}
+		m, ok := byID[parts[1]]
+		if !ok {
+			return fmt.Errorf("MIGRATION_PLAN step %q names an unknown migration", item)
+		}
+		switch parts[0] {
+		case "up":
+			steps = append(steps, step{migrate.Up, m})
+		case "down":
+			steps = append(steps, step{migrate.Down, m})
+		default:
+			return fmt.Errorf("Invalid MIGRATION_PLAN step %q, expected down:ID or up:ID", item)
+		}
+	}
+	if len(steps) == 0 {
+		return errors.New("MIGRATION_PLAN has no steps")
+	}
+
+	for i, st := range steps {
+		applied, err := appliedMigrationIDs(db)
+		if err != nil {
+			return err
+		}
+
+		planned := &migrate.PlannedMigration{Migration: st.migration}
+		if st.dir == migrate.Up {
+			if applied[st.migration.Id] {
+				return fmt.Errorf("Plan step %d: %s is already applied", i+1, st.migration.Id)
+			}
+			planned.Queries = st.migration.Up
+			planned.DisableTransaction = st.migration.DisableTransactionUp
+			logf("Plan step %d: applying %s\n", i+1, st.migration.Id)
+		} else {
+			if !applied[st.migration.Id] {
+				return fmt.Errorf("Plan step %d: %s is not applied, nothing to roll back", i+1, st.migration.Id)
+			}
+			planned.Queries = st.migration.Down
+			planned.DisableTransaction = st.migration.DisableTransactionDown
+			logf("Plan step %d: rolling back %s\n", i+1, st.migration.Id)
+		}
+
+		if err := applyMigration(db, source, planned, st.dir); err != nil {
+			return fmt.Errorf("Plan step %d failed: %+v", i+1, err)
+		}
+	}
+	logf("Executed %d plan steps!\n", len(steps))
+	return nil
+}
+
+// sqlExecutor is satisfied by both *sql.DB and *sql.Tx
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// ignoringExecutor treats statements failing with one of IGNORE_SQLSTATES as
+// successful. In a transaction each statement runs under a savepoint, so the
+// failure doesn't abort the rest of the migration
+type ignoringExecutor struct {
+	id     string
+	target sqlExecutor
+	inTx   bool
+}
+
+func (e ignoringExecutor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if e.inTx {
+		if _, err := e.target.Exec("SAVEPOINT migrator_ignore_sqlstate"); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := e.target.Exec(query, args...)
+	if pqErr, ok := err.(*pq.Error); ok && ignoredSQLStates[string(pqErr.Code)] {
+		logf("Warning, migration %s ignored error %s (%s) as listed in IGNORE_SQLSTATES\n", e.id, pqErr.Code, pqErr.Message)
+		if e.inTx {
+			if _, err := e.target.Exec("ROLLBACK TO SAVEPOINT migrator_ignore_sqlstate"); err != nil {
+				return nil, err
+			}
+		}
+		return driver.RowsAffected(0), nil
+	}
+	if err != nil || !e.inTx {
+		return result, err
+	}
+	if _, err := e.target.Exec("RELEASE SAVEPOINT migrator_ignore_sqlstate"); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// skipPending excludes the listed pending migrations from the plan. Listed
+// ids that are already applied or unknown are only reported
+func skipPending(source *extensionMigrationSource, ids []string, applied map[string]bool) ([]string, error) {
+	all, err := source.FindMigrations()
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, m := range all {
+		known[m.Id] = true
+	}
+
+	source.Skip = map[string]bool{}
+	var skipped []string
+	for _, id := range ids {
+		switch {
+		case applied[id]:
+			logf("Warning, SKIP_MIGRATIONS lists %s which is already applied, nothing to skip\n", id)
+		case !known[id]:
+			logf("Warning, SKIP_MIGRATIONS lists %s which is not a migration\n", id)
+		default:
+			logf("SKIPPING MIGRATION %s as listed in SKIP_MIGRATIONS, it stays pending until removed from the list\n", id)
+			source.Skip[id] = true
+			skipped = append(skipped, id)
+		}
+	}
+	return skipped, nil
+}
+
+// checkDownSections fails when a migration has a missing or empty Down
+// section, for environments that mandate reversibility
+func checkDownSections(source *extensionMigrationSource) error {
+	all, err := source.FindMigrations()
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, m := range all {
+		statements := m.Down
+		streamed, err := source.overSizeCap(m.Id)
+		if err != nil {
+			return err
+		}
+		if streamed {
+			// Collect the Down statements without running them
+			collector := &collectingExecutor{}
+			if err := streamMigration(collector, filepath.Join(source.Dir, m.Id), migrate.Down); err != nil {
+				return fmt.Errorf("Error while parsing %s: %+v", m.Id, err)
+			}
+			statements = collector.statements
+		}
+
+		hasStatement := false
+		for _, stmt := range statements {
+			hasStatement = hasStatement || !isEmptyStatement(stmt)
+		}
+		if !hasStatement {
+			missing = append(missing, m.Id)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("REQUIRE_DOWN is set but these migrations have no Down statements: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// collectingExecutor records statements instead of executing them
+type collectingExecutor struct {
+	statements []string
+}
+
+func (e *collectingExecutor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	e.statements = append(e.statements, query)
+	return driver.RowsAffected(0), nil
+}
+
+// contextExecutor runs every Exec with ctx, on a *sql.DB or *sql.Tx
+type contextExecutor struct {
+	ctx    context.Context
+	target interface {
+		ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	}
+}
+
+func (e contextExecutor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return e.target.ExecContext(e.ctx, query, args...)
+}
+
+// recordMigration adds or removes the migration's row in the tracking table
+func recordMigration(executor sqlExecutor, id string, dir migrate.MigrationDirection) error {
+	table := trackingTableName()
+	var err error
+	if dir == migrate.Up {
+		_, err = executor.Exec("INSERT INTO "+table+" (id, applied_at) VALUES ($1, $2)", id, time.Now())
+	} else {
+		_, err = executor.Exec("DELETE FROM "+table+" WHERE id = $1", id)
+	}
+	return err
+}
+
+// trimStatement strips the terminator like sql-migrate does before executing
+func trimStatement(stmt string) string {
+	stmt = strings.TrimSuffix(stmt, "\n")
+	stmt = strings.TrimSuffix(stmt, " ")
+	return strings.TrimSuffix(stmt, ";")
+}
+
+// redoMigrations rolls back the latest n applied migrations and applies them
+// again. The re-apply runs exactly the rolled back migrations, a fresh Up plan
+// would pick up gaps in the tracking table and skipped pending ones too
+func redoMigrations(db *sql.DB, source *extensionMigrationSource, n int, opts applyOptions) error {
+	planned, _, err := migrate.PlanMigration(db, "postgres", source, migrate.Down, n)
+	if err != nil {
+		return err
+	}
+	if len(planned) == 0 {
+		logln("No applied migrations to redo")
+		return nil
+	}
+
+	for _, m := range planned {
+		logln("Rolling back migration: ", m.Id)
+	}
+	down, err := applyPlanned(db, source, planned, migrate.Down, opts)
+	if err != nil {
+		return fmt.Errorf("Redo failed rolling back: %+v", err)
+	}
+	logf("Rolled back %d migrations!\n", down)
+
+	reapply := redoPlan(planned)
+	for _, m := range reapply {
+		logln("Re-applying migration: ", m.Id)
+	}
+	up, err := applyPlanned(db, source, reapply, migrate.Up, opts)
+	if err != nil {
+		return fmt.Errorf("Redo failed re-applying: %+v", err)
+	}
+	logf("Re-applied %d migrations!\n", up)
+	return nil
+}
+
+// redoPlan turns the rolled back migrations into their Up plan, oldest first
+func redoPlan(rolledBack []*migrate.PlannedMigration) []*migrate.PlannedMigration {
+	reapply := make([]*migrate.PlannedMigration, 0, len(rolledBack))
+	for i := len(rolledBack) - 1; i >= 0; i-- {
+		m := rolledBack[i].Migration
+		reapply = append(reapply, &migrate.PlannedMigration{
+			Migration:          m,
+			Queries:            m.Up,
+			DisableTransaction: m.DisableTransactionUp,
+		})
+	}
+	return reapply
+}
+
+// checkTrackingTableUntouched refuses pending migrations that reference the
+// tracking table, since altering it corrupts every subsequent run
+func checkTrackingTableUntouched(db *sql.DB, source *extensionMigrationSource, table string) error {
+	planned, _, err := migrate.PlanMigration(db, "postgres", source, migrate.Up, 0)
+	if err != nil {
+		return err
+	}
+
+	var offending []string
+	for _, m := range planned {
+		touches, err := referencesTable(source, m, table)
+		if err != nil {
+			return err
+		}
+		if touches {
+			offending = append(offending, m.Id)
+		}
+	}
+
+	if len(offending) > 0 {
+		return fmt.Errorf("Pending migrations reference the tracking table %q: %s. Set ALLOW_TRACKING_TABLE_MODIFICATION=yes if this is intended", table, strings.Join(offending, ", "))
+	}
+	return nil
+}
+
+// referencesTable reports whether an Up statement of a planned migration
+// names table, streaming the statements of files over the size cap
+func referencesTable(source *extensionMigrationSource, m *migrate.PlannedMigration, table string) (bool, error) {
+	matcher := &matchingExecutor{pattern: regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(table) + `\b`)}
+	if err := execUpStatements(matcher, source, m); err != nil {
+		return false, fmt.Errorf("Error while parsing %s: %+v", m.Id, err)
+	}
+	return matcher.matched, nil
+}
+
+// matchingExecutor records whether any statement matches pattern, without running or keeping them
+type matchingExecutor struct {
+	pattern *regexp.Regexp
+	matched bool
+}
+
+func (e *matchingExecutor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	e.matched = e.matched || e.pattern.MatchString(query)
+	return driver.RowsAffected(0), nil
+}
+
+// appliedMigrationIDs reads the set of migration ids in the tracking table
+func appliedMigrationIDs(db *sql.DB) (map[string]bool, error) {
+	records, err := migrate.GetMigrationRecords(db, "postgres")
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool, len(records))
+	for _, r := range records {
+		ids[r.Id] = true
+	}
+	return ids, nil
+}
+
+// diffMigrationIDs splits the known migrations into the ones this run applied
+// and the ones skipped because they were already applied before it
+func diffMigrationIDs(db *sql.DB, source migrate.MigrationSource, before map[string]bool) (applied, skipped []string, err error) {
+	after, err := appliedMigrationIDs(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	all, err := source.FindMigrations()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	applied, skipped = []string{}, []string{}
+	for _, m := range all {
+		switch {
+		case before[m.Id]:
+			skipped = append(skipped, m.Id)
+		case after[m.Id]:
+			applied = append(applied, m.Id)
+		}
+	}
+	return applied, skipped, nil
+}
+
+// runValidatorCommand runs an external linter over the migration files, which
+// are appended to command as arguments. A non-zero exit blocks the run
+func runValidatorCommand(command string, source *extensionMigrationSource) error {
+	files, err := source.Files()
+	if err != nil {
+		return err
+	}
+	paths := make([]string, 0, len(files))
+	for _, name := range files {
+		paths = append(paths, filepath.Join(source.Dir, name))
+	}
+
+	args := strings.Fields(command)
+	logln("Running MIGRATION_VALIDATOR_CMD: ", command)
+	cmd := exec.Command(args[0], append(args[1:], paths...)...)
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		logln("MIGRATION_VALIDATOR_CMD output: ", string(output))
+	}
+	if err == nil {
+		return nil
+	}
+
+	// Point at the files the validator complained about, if it named any
+	var offending []string
+	for _, name := range files {
+		if strings.Contains(string(output), name) {
+			offending = append(offending, name)
+		}
+	}
+	if len(offending) > 0 {
+		return fmt.Errorf("MIGRATION_VALIDATOR_CMD rejected migrations %s: %+v", strings.Join(offending, ", "), err)
+	}
+	return fmt.Errorf("MIGRATION_VALIDATOR_CMD rejected the migrations: %+v", err)
+}
+
+// lastAppliedMigration returns the id of the latest migration, in source order,
+// that is already applied and how many migrations are still pending
+func lastAppliedMigration(db *sql.DB, source migrate.MigrationSource, applied map[string]bool) (string, int, error) {
+	all, err := source.FindMigrations()
+	if err != nil {
+		return "", 0, err
+	}
+	planned, _, err := migrate.PlanMigration(db, "postgres", source, migrate.Up, 0)
+	if err != nil {
+		return "", 0, err
+	}
+
+	last := ""
+	for _, m := range all {
+		if applied[m.Id] {
+			last = m.Id
+		}
+	}
+	return last, len(planned), nil
+}
+
+// checkTrackingCollision warns when most records in the tracking table match
+// no migration file, which suggests another app's migrations share the table
+func checkTrackingCollision(db *sql.DB, source migrate.MigrationSource) error {
+	applied, err := appliedMigrationIDs(db)
+	if err != nil || len(applied) == 0 {
+		return err
+	}
+	all, err := source.FindMigrations()
+	if err != nil {
+		return err
+	}
+	files := map[string]bool{}
+	for _, m := range all {
+		files[m.Id] = true
+	}
+
+	unknown := 0
+	for id := range applied {
+		if !files[id] {
+			unknown++
+		}
+	}
+	if unknown*2 > len(applied) {
+		logf("Warning, %d of the %d records in tracking table %s match no migration file, another app probably uses the same table. Check MIGRATIONS_TABLE and DB_SCHEMA\n", unknown, len(applied), trackingTableLabel())
+	}
+	return nil
+}
+
+// checkTrackingDrift compares the tracking table with the migration files and
+// reports applied ids whose file was renamed or is gone. Under strict these
+// are errors instead of warnings
+func checkTrackingDrift(db *sql.DB, source migrate.MigrationSource, strict bool) error {
+	applied, err := appliedMigrationIDs(db)
+	if err != nil {
+		return err
+	}
+	all, err := source.FindMigrations()
+	if err != nil {
+		return err
+	}
+
+	files := map[string]bool{}
+	byVersion := map[int64][]string{}
+	for _, m := range all {
+		files[m.Id] = true
+		if len(m.NumberPrefixMatches()) > 0 {
+			byVersion[m.VersionInt()] = append(byVersion[m.VersionInt()], m.Id)
+		}
+	}
+
+	var problems []string
+	for id := range applied {
+		if files[id] {
+			continue
+		}
+		record := &migrate.Migration{Id: id}
+		if len(record.NumberPrefixMatches()) > 0 {
+			if names, ok := byVersion[record.VersionInt()]; ok {
+				problems = append(problems, fmt.Sprintf("applied %s has the same version as %s, was it renamed?", id, strings.Join(names, ", ")))
+				continue
+			}
+		}
+		problems = append(problems, fmt.Sprintf("applied %s has no migration file", id))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+
+	if strict {
+		return fmt.Errorf("Tracking table doesn't match the migration files: %s", strings.Join(problems, "; "))
+	}
+	for _, problem := range problems {
+		logln("Warning, tracking table drift: ", problem)
+	}
+	// Otherwise the planner refuses to run with ids it can't find on disk
+	migrate.SetIgnoreUnknown(true)
+	return nil
+}
+
+// checkAppliedPrefix reports applied migrations that come after an unapplied
+// one in version order, e.g. 1, 2 and 4 applied but not 3, left by
+// out-of-band or filtered applies. Under strict these are errors instead of
+// warnings, otherwise the next run fills the gap
+func checkAppliedPrefix(db *sql.DB, source migrate.MigrationSource, strict bool) error {
+	applied, err := appliedMigrationIDs(db)
+	if err != nil {
+		return err
+	}
+	all, err := source.FindMigrations()
+	if err != nil {
+		return err
+	}
+
+	var firstGap string
+	var outOfOrder []string
+	for _, m := range all {
+		if !applied[m.Id] {
+			if len(firstGap) == 0 {
+				firstGap = m.Id
+			}
+			continue
+		}
+		if len(firstGap) > 0 {
+			outOfOrder = append(outOfOrder, m.Id)
+		}
+	}
+	if len(outOfOrder) == 0 {
+		return nil
+	}
+
+	if strict {
+		return fmt.Errorf("Applied migrations aren't a prefix of the migration files, these come after unapplied %s: %s", firstGap, strings.Join(outOfOrder, ", "))
+	}
+	logf("Warning, these applied migrations come after unapplied %s, the gap will be filled in: %s\n", firstGap, strings.Join(outOfOrder, ", "))
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/rubenv/sql-migrate"
+)
+
+// testSource writes the migration files to a temporary folder, streaming any
+// file over maxBytes
+func testSource(t *testing.T, maxBytes int64, files map[string]string) *extensionMigrationSource {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &extensionMigrationSource{Dir: dir, Extensions: []string{".sql"}, MaxFileBytes: maxBytes, Stream: true}
+}
+
+// plannedUp plans every migration of source up, the way PlanMigration does for an empty database
+func plannedUp(t *testing.T, source *extensionMigrationSource) []*migrate.PlannedMigration {
+	t.Helper()
+	all, err := source.FindMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var planned []*migrate.PlannedMigration
+	for _, m := range all {
+		planned = append(planned, &migrate.PlannedMigration{Migration: m, Queries: m.Up})
+	}
+	return planned
+}
+
+func TestReferencesTable(t *testing.T) {
+	touching := "-- +migrate Up\nCREATE TABLE users (id int);\nDELETE FROM gorp_migrations WHERE id = 'x';\n-- +migrate Down\nDROP TABLE users;\n"
+	clean := "-- +migrate Up\nCREATE TABLE users (id int);\n-- +migrate Down\nDELETE FROM gorp_migrations;\n"
+
+	for _, tc := range []struct {
+		name     string
+		maxBytes int64
+		content  string
+		want     bool
+	}{
+		{"in memory", 0, touching, true},
+		{"streamed", 16, touching, true},
+		{"only down, in memory", 0, clean, false},
+		{"only down, streamed", 16, clean, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			source := testSource(t, tc.maxBytes, map[string]string{"1_users.sql": tc.content})
+			planned := plannedUp(t, source)
+			if tc.maxBytes > 0 && len(planned[0].Queries) != 0 {
+				t.Fatalf("expected a streamed placeholder, got %d queries", len(planned[0].Queries))
+			}
+			got, err := referencesTable(source, planned[0], DefaultMigrationsTable)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("referencesTable = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRedoPlan(t *testing.T) {
+	up := func(id string) *migrate.Migration {
+		return &migrate.Migration{Id: id, Up: []string{"up " + id}, Down: []string{"down " + id}, DisableTransactionUp: id == "3_c.sql"}
+	}
+	rolledBack := []*migrate.PlannedMigration{
+		{Migration: up("3_c.sql"), Queries: []string{"down 3_c.sql"}},
+		{Migration: up("1_a.sql"), Queries: []string{"down 1_a.sql"}},
+	}
+
+	reapply := redoPlan(rolledBack)
+	var got []string
+	for _, m := range reapply {
+		got = append(got, m.Id+": "+m.Queries[0])
+	}
+	want := []string{"1_a.sql: up 1_a.sql", "3_c.sql: up 3_c.sql"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("redoPlan = %v, want %v", got, want)
+	}
+	if reapply[0].DisableTransaction || !reapply[1].DisableTransaction {
+		t.Errorf("redoPlan should take DisableTransactionUp of each migration")
+	}
+}
+
+// testDatabase creates a throwaway database next to MIGRATOR_TEST_DSN, a
+// postgres:// URL with CREATEDB rights, and skips the test without one
+func testDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("MIGRATOR_TEST_DSN")
+	if len(dsn) == 0 {
+		t.Skip("MIGRATOR_TEST_DSN not set")
+	}
+	base, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { base.Close() })
+
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		t.Fatal(err)
+	}
+	name := fmt.Sprintf("migrator_test_%x", suffix)
+	if _, err := base.Exec("CREATE DATABASE " + pq.QuoteIdentifier(name)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { base.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(name)) })
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Path = "/" + name
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestRedoMigrationsWithGap(t *testing.T) {
+	db := testDatabase(t)
+	source := testSource(t, 0, map[string]string{
+		"1_a.sql": "-- +migrate Up\nCREATE TABLE a (id int);\n-- +migrate Down\nDROP TABLE a;\n",
+		"2_b.sql": "-- +migrate Up\nCREATE TABLE b (id int);\n-- +migrate Down\nDROP TABLE b;\n",
+		"3_c.sql": "-- +migrate Up\nCREATE TABLE c (id int);\n-- +migrate Down\nDROP TABLE c;\n",
+	})
+
+	// Apply 1 and 3, leaving 2 as a gap in the tracking table
+	if _, err := applyMigrations(db, source, migrate.Up, 1, applyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	planned := plannedUp(t, source)
+	if _, err := applyPlanned(db, source, planned[2:], migrate.Up, applyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := redoMigrations(db, source, 1, applyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := appliedMigrationIDs(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for id := range applied {
+		got = append(got, id)
+	}
+	sort.Strings(got)
+	if want := []string{"1_a.sql", "3_c.sql"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("applied after redo = %v, want %v, the gap must stay a gap", got, want)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// noticeState attributes server notices to the migration being applied and
+// collects its warnings for FAIL_ON_WARNING
+var noticeState struct {
+	sync.Mutex
+	migration string
+	warnings  []string
+}
+
+// logNotice is the pq notice handler of every connection, it logs RAISE
+// NOTICE and friends under the migration that emitted them
+func logNotice(notice *pq.Error) {
+	noticeState.Lock()
+	defer noticeState.Unlock()
+
+	source := noticeState.migration
+	if len(source) == 0 {
+		source = "migrator"
+	}
+	logf("Postgres %s (%s): %s\n", notice.Severity, source, notice.Message)
+	if notice.Severity == "WARNING" && len(noticeState.migration) > 0 {
+		noticeState.warnings = append(noticeState.warnings, notice.Message)
+	}
+}
+
+// beginNotices attributes the notices that follow to the migration id
+func beginNotices(id string) {
+	noticeState.Lock()
+	defer noticeState.Unlock()
+	noticeState.migration, noticeState.warnings = id, nil
+}
+
+// endNotices stops attributing notices and, under failOnWarning, fails when
+// the migration raised a WARNING
+func endNotices(failOnWarning bool) error {
+	noticeState.Lock()
+	defer noticeState.Unlock()
+	id, warnings := noticeState.migration, noticeState.warnings
+	noticeState.migration, noticeState.warnings = "", nil
+
+	if failOnWarning && len(warnings) > 0 {
+		return fmt.Errorf("Migration %s raised warnings and FAIL_ON_WARNING is set: %s", id, strings.Join(warnings, "; "))
+	}
+	return nil
+}
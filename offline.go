@@ -0,0 +1,29 @@
+package main
+
+import "fmt"
+
+// offlineMode refuses every network operation, see -offline and OFFLINE
+var offlineMode bool
+
+// stripOfflineFlag takes -offline, or --offline, out of the arguments so it
+// works with every command
+func stripOfflineFlag(args []string) ([]string, bool) {
+	var rest []string
+	offline := false
+	for _, arg := range args {
+		if arg == "-offline" || arg == "--offline" {
+			offline = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return rest, offline
+}
+
+// requireNetwork fails in offline mode, naming the operation that needed the network
+func requireNetwork(operation string) error {
+	if offlineMode {
+		return fmt.Errorf("Offline mode: %s needs the network, refusing. Only new, validate, version, help and -print-config work offline", operation)
+	}
+	return nil
+}
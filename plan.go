@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rubenv/sql-migrate"
+)
+
+// DefaultPlanReportFormat is used when PLAN_REPORT_FORMAT is unset
+const DefaultPlanReportFormat = "text"
+
+// planEntry is one pending migration in a plan report
+type planEntry struct {
+	ID          string   `json:"id"`
+	Description string   `json:"description,omitempty"`
+	Statements  []string `json:"statements"`
+	Streamed    bool     `json:"streamed,omitempty"`
+}
+
+// pendingPlan lists the migrations an Up run would apply, in order
+func pendingPlan(db *sql.DB, source *extensionMigrationSource) ([]planEntry, error) {
+	planned, _, err := migrate.PlanMigration(db, "postgres", source, migrate.Up, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []planEntry{}
+	for _, m := range planned {
+		description, err := migrationDescription(filepath.Join(source.Dir, m.Id))
+		if err != nil {
+			return nil, err
+		}
+		streamed, err := source.overSizeCap(m.Id)
+		if err != nil {
+			return nil, err
+		}
+		entry := planEntry{ID: m.Id, Description: description, Streamed: streamed, Statements: []string{}}
+		for _, stmt := range m.Queries {
+			entry.Statements = append(entry.Statements, trimStatement(stmt))
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// migrationDescription is the text of the comment lines a migration file
+// starts with, before its first annotation or statement
+func migrationDescription(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var lines []string
+	err = readLines(file, func(line string) (bool, error) {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, migrateCommandPrefix) || (len(trimmed) > 0 && !strings.HasPrefix(trimmed, "--")) {
+			return false, nil
+		}
+		if trimmed == spaceIntensiveMarker {
+			return true, nil
+		}
+		if text := strings.TrimSpace(strings.TrimPrefix(trimmed, "--")); len(text) > 0 {
+			lines = append(lines, text)
+		}
+		return true, nil
+	})
+	return strings.Join(lines, " "), err
+}
+
+// formatPlan renders a plan report as text, json or markdown
+func formatPlan(entries []planEntry, format string) (string, error) {
+	switch format {
+	case "", "text":
+		var b strings.Builder
+		fmt.Fprintf(&b, "%d pending migrations\n", len(entries))
+		for _, e := range entries {
+			if len(e.Description) > 0 {
+				fmt.Fprintf(&b, "%s: %s\n", e.ID, e.Description)
+			} else {
+				fmt.Fprintln(&b, e.ID)
+			}
+		}
+		return b.String(), nil
+	case "json":
+		bytez, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(bytez) + "\n", nil
+	case "markdown":
+		var b strings.Builder
+		fmt.Fprintf(&b, "# Migration plan\n\n%d pending migrations.\n", len(entries))
+		for i, e := range entries {
+			fmt.Fprintf(&b, "\n## %d. %s\n\n", i+1, e.ID)
+			if len(e.Description) > 0 {
+				fmt.Fprintf(&b, "%s\n\n", e.Description)
+			}
+			if e.Streamed {
+				fmt.Fprintf(&b, "_Too large to include, it is streamed from disk when applied._\n")
+				continue
+			}
+			sql := strings.Join(e.Statements, "\n\n")
+			fence := markdownFence(sql)
+			fmt.Fprintf(&b, "%ssql\n%s\n%s\n", fence, sql, fence)
+		}
+		return b.String(), nil
+	default:
+		return "", fmt.Errorf("Invalid PLAN_REPORT_FORMAT %q, expected text, json or markdown", format)
+	}
+}
+
+// markdownFence is a backtick fence longer than any backtick run in content
+func markdownFence(content string) string {
+	longest, run := 0, 0
+	for _, c := range content {
+		if c == '`' {
+			run++
+			if run > longest {
+				longest = run
+			}
+		} else {
+			run = 0
+		}
+	}
+	if longest < 3 {
+		return "```"
+	}
+	return strings.Repeat("`", longest+1)
+}
+
+// writePlanReport writes the report to path, or prints it when path is empty
+func writePlanReport(report, path string) error {
+	if len(path) == 0 {
+		outputf("%s", report)
+		return nil
+	}
+	if err := ioutil.WriteFile(path, []byte(report), 0644); err != nil {
+		return err
+	}
+	logln("Wrote plan report to: ", path)
+	return nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// startProxy launches cloud_sql_proxy for the instance on port and waits until
+// it accepts connections. It returns the process and a channel closed when
+// the process exits. On failure the process is killed so it can be retried
+func startProxy(path, instanceID string, port int) (*exec.Cmd, chan struct{}, error) {
+	instanceArg := fmt.Sprintf("-instances=%s=tcp:%d", instanceID, port)
+	logln("Instance args: ", instanceArg)
+	args := []string{instanceArg}
+	if len(sqladminEndpoint) > 0 {
+		args = append(args, "-host="+sqladminEndpoint)
+	}
+
+	// Build out the cmd
+	attr, err := proxySysProcAttr()
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Env = proxyEnv()
+	cmd.SysProcAttr = attr
+	stderr, stderrWriter := io.Pipe()
+	cmd.Stdout = stderrWriter
+	cmd.Stderr = stderrWriter
+
+	// Optionally keep the proxy's output out of the main log, in its own file
+	var proxyLog *os.File
+	if path := os.Getenv("PROXY_LOG_FILE"); len(path) > 0 {
+		if proxyLog, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			return nil, nil, fmt.Errorf("Could not open PROXY_LOG_FILE: %+v", err)
+		}
+		logln("Writing the proxy's output to: ", path)
+	}
+
+	// Start the process
+	if err := cmd.Start(); err != nil {
+		if proxyLog != nil {
+			proxyLog.Close()
+		}
+		return nil, nil, fmt.Errorf("Could not start cloud SQL Proxy with error: %+v", err)
+	}
+
+	// Scan the output to listen for a successful connection
+	readyCh := make(chan struct{})
+	skewCh := make(chan string, 1)
+	scanDone := make(chan struct{})
+	go func() {
+		defer close(scanDone)
+		if proxyLog != nil {
+			defer proxyLog.Close()
+		}
+		ready := false
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if proxyLog != nil {
+				stamp := time.Now().UTC().Format(LogTimeFormat)
+				fmt.Fprintln(proxyLog, stamp, line)
+				recentLogs.add(stamp + " SQL Logs: " + line)
+			} else {
+				logln("SQL Logs: ", line)
+			}
+			if !ready && strings.Contains(line, "Ready for new connections") {
+				ready = true
+				close(readyCh)
+			}
+			if !ready && isClockSkewError(line) {
+				select {
+				case skewCh <- line:
+				default:
+				}
+			}
+		}
+	}()
+
+	// Dispatch GoRoutine for waiting on the process
+	waitCh := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		close(done)
+		stderrWriter.Close()
+		waitCh <- err
+	}()
+	trackProxy(cmd, done)
+
+	select {
+	case <-readyCh:
+		go func() {
+			if err := <-waitCh; err != nil {
+				logln("Cloud SQL Proxy exited with error: ", err)
+			}
+		}()
+		return cmd, done, nil
+	case err := <-waitCh:
+		<-scanDone
+		if skewErr := clockSkewError(skewCh); skewErr != nil {
+			return nil, nil, skewErr
+		}
+		return nil, nil, fmt.Errorf("Could not start cloud SQL Proxy with error: %+v%s", err, proxyLogHint(proxyLog))
+	case <-time.After(ProxyStartTimeout):
+		killProxy(cmd, done)
+		if skewErr := clockSkewError(skewCh); skewErr != nil {
+			return nil, nil, skewErr
+		}
+		return nil, nil, fmt.Errorf("Proxy setup timed out%s", proxyLogHint(proxyLog))
+	}
+}
+
+// proxyEnvAllowlist is what a proxy running as PROXY_RUN_AS_UID/PROXY_RUN_AS_GID
+// gets of our environment, the rest holds secrets like DB_PASS it doesn't need
+var proxyEnvAllowlist = []string{
+	"PATH", "HOME", "TZ", "TMPDIR",
+	"GOOGLE_APPLICATION_CREDENTIALS",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+}
+
+// proxyEnvPrefix marks the proxy's own settings, passed on as well
+const proxyEnvPrefix = "CSQL_PROXY_"
+
+// proxyEnv is the proxy's environment. A proxy under our own identity gets
+// all of it, one dropped to another uid/gid only the allowlisted variables
+func proxyEnv() []string {
+	if len(os.Getenv("PROXY_RUN_AS_UID")) == 0 && len(os.Getenv("PROXY_RUN_AS_GID")) == 0 {
+		return os.Environ()
+	}
+	allowed := make(map[string]bool, len(proxyEnvAllowlist))
+	for _, name := range proxyEnvAllowlist {
+		allowed[name] = true
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if allowed[name] || strings.HasPrefix(name, proxyEnvPrefix) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// proxyLogHint points an error at PROXY_LOG_FILE, where the proxy's output went instead of the log
+func proxyLogHint(proxyLog *os.File) string {
+	if proxyLog == nil {
+		return ""
+	}
+	return ", see its output in " + proxyLog.Name()
+}
+
+// clockSkewMarkers are fragments of the auth errors Google returns when the
+// token timestamps don't line up with its clock
+var clockSkewMarkers = []string{
+	"used before issued",
+	"reasonable timeframe",
+	"iat and exp",
+}
+
+// isClockSkewError reports whether a proxy log line is a time related auth failure
+func isClockSkewError(line string) bool {
+	lower := strings.ToLower(line)
+	for _, marker := range clockSkewMarkers {
+		if strings.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// clockSkewError translates a captured clock related auth failure, if any
+func clockSkewError(skewCh chan string) error {
+	select {
+	case line := <-skewCh:
+		return fmt.Errorf("Authentication failed, likely due to container clock skew. Check the host/container time. Proxy said: %s", line)
+	default:
+		return nil
+	}
+}
+
+// runOnReadyCommand runs a shell command once the proxy accepts connections,
+// with the libpq environment pointing at the tunnel
+func runOnReadyCommand(command, dbUser, dbPass, dbName string) error {
+	logln("Running ON_READY_COMMAND: ", command)
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"PGHOST=localhost",
+		fmt.Sprintf("PGPORT=%d", SQLCloudProxyPort),
+		"PGUSER="+dbUser,
+		"PGPASSWORD="+dbPass,
+		"PGDATABASE="+dbName,
+	)
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		logln("ON_READY_COMMAND output: ", string(output))
+	}
+	if err != nil {
+		return fmt.Errorf("ON_READY_COMMAND failed with error: %+v", err)
+	}
+	return nil
+}
+
+// proxyVersion asks the proxy binary for its version, "unknown" if it can't tell
+func proxyVersion(path string) string {
+	output, err := exec.Command(path, "-version").CombinedOutput()
+	version := strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+	if err != nil || len(version) == 0 {
+		return "unknown"
+	}
+	return version
+}
+
+// checkForProxy finds an executable proxy binary, failing with ExitProxyMissing
+func checkForProxy() (string, error) {
+	path, err := findBinary(SQLCloudProxyBinary)
+	if err != nil {
+		return "", &exitError{code: ExitProxyMissing, err: err}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", &exitError{code: ExitProxyMissing, err: err}
+	}
+	// Windows has no executable bits to check
+	if runtime.GOOS != "windows" && info.Mode()&0111 == 0 {
+		return "", &exitError{code: ExitProxyMissing, err: fmt.Errorf("Proxy binary %s is not executable (mode %s)", path, info.Mode())}
+	}
+	return path, nil
+}
+
+// findBinary looks for the named binary in the working directory, then in PATH
+func findBinary(name string) (string, error) {
+	// Check for the binary in the same folder
+	files, err := ioutil.ReadDir("./")
+	if err != nil {
+		return "", err
+	}
+
+	// Try to find the binary locally
+	for _, f := range files {
+		if f.Name() == name {
+			localPath := fmt.Sprintf("./%s", name)
+			return localPath, nil
+		}
+	}
+
+	// Fall back to searching PATH
+	binary, lookErr := exec.LookPath(name)
+	if lookErr != nil {
+		return "", fmt.Errorf("Invalid binary %s. Not in path", name)
+	}
+	return binary, nil
+}
+
+// checkProxyPortFree refuses to continue when something already listens on the
+// proxy port, since a stale tunnel may point at a different instance. Asking
+// the listener which database it serves sends it DB_USER and DB_PASS, so that
+// only happens under PROXY_PORT_PROBE=true
+func checkProxyPortFree(pgURL string, port int) error {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", port), time.Second)
+	if err != nil {
+		// Nothing listening, we're free to start the proxy
+		return nil
+	}
+	conn.Close()
+	if os.Getenv("PROXY_PORT_PROBE") != "true" {
+		return fmt.Errorf("Port %d is already in use, likely a leftover proxy that may point at a different instance. Stop it before running migrations, PROXY_PORT_PROBE=true asks it which database it serves", port)
+	}
+
+	// Find out what the existing listener is serving to give a useful error
+	db, err := sql.Open("postgres", pgURL)
+	if err != nil {
+		return fmt.Errorf("Port %d is already in use: %+v", port, err)
+	}
+	defer db.Close()
+
+	// A half-open stale tunnel accepts the connection and then never answers
+	var currentDB, serverAddr string
+	err = withPingTimeout(func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, "SELECT current_database(), COALESCE(host(inet_server_addr()), '')").Scan(&currentDB, &serverAddr)
+	})
+	if err != nil {
+		return fmt.Errorf("Port %d is already in use by something that isn't serving our database: %+v", port, err)
+	}
+	return fmt.Errorf("Port %d is already serving database %q (server address %q), likely a leftover proxy that may point at a different instance. Stop it before running migrations", port, currentDB, serverAddr)
+}
+
+// The proxies started and not killed yet, the main one and a shadow clone's
+var (
+	runningProxiesMu sync.Mutex
+	runningProxies   = map[*exec.Cmd]chan struct{}{}
+)
+
+// trackProxy registers a started proxy for the signal trap, untrackProxy forgets it again
+func trackProxy(cmd *exec.Cmd, done chan struct{}) {
+	runningProxiesMu.Lock()
+	defer runningProxiesMu.Unlock()
+	runningProxies[cmd] = done
+}
+
+func untrackProxy(cmd *exec.Cmd) {
+	runningProxiesMu.Lock()
+	defer runningProxiesMu.Unlock()
+	delete(runningProxies, cmd)
+}
+
+// trapKillForCleanup kills every running proxy on SIGINT or SIGTERM, which is
+// what Kubernetes sends, and exits. SIGKILL can't be caught
+func trapKillForCleanup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		runningProxiesMu.Lock()
+		proxies := make(map[*exec.Cmd]chan struct{}, len(runningProxies))
+		for cmd, done := range runningProxies {
+			proxies[cmd] = done
+		}
+		runningProxiesMu.Unlock()
+		for cmd, done := range proxies {
+			killProxy(cmd, done)
+		}
+		pError(fmt.Errorf("Received %s, stopped %d proxies", sig, len(proxies)))
+	}()
+}
+
+// Ensuring we're killing our child process
+func ensureProcessKill(cmdProcess *exec.Cmd) error {
+	var done chan struct{}
+	if cmdProcess == proxyCMD {
+		done = proxyDone
+	}
+	killProxy(cmdProcess, done)
+	return nil
+}
+
+// killProxy kills a proxy process and waits up to KILL_TIMEOUT for done, the
+// channel startProxy returned with it, when there is one
+func killProxy(cmdProcess *exec.Cmd, done chan struct{}) {
+	if cmdProcess != nil && cmdProcess.Process != nil {
+		// Try the normal way
+		cmdProcess.Process.Kill()
+
+		// Sometimes go doesn't kill the process. Lets send a sig 9
+		killProcessGroup(cmdProcess.Process.Pid)
+
+		untrackProxy(cmdProcess)
+
+		// Don't let a wedged process hang our exit
+		if done != nil {
+			select {
+			case <-done:
+			case <-time.After(killTimeout):
+				logf("Proxy (pid %d) did not exit within %s, it may be orphaned\n", cmdProcess.Process.Pid, killTimeout)
+			}
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// proxySysProcAttr has nothing to set here, running as another uid/gid is Unix only
+func proxySysProcAttr() (*syscall.SysProcAttr, error) {
+	if len(os.Getenv("PROXY_RUN_AS_UID")) > 0 || len(os.Getenv("PROXY_RUN_AS_GID")) > 0 {
+		return nil, errors.New("PROXY_RUN_AS_UID and PROXY_RUN_AS_GID are only supported on Unix")
+	}
+	return nil, nil
+}
+
+// killProcessGroup has nothing to do here, the proxy isn't put in a group of its own
+func killProcessGroup(pid int) {}
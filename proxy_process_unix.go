@@ -0,0 +1,92 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// proxySysProcAttr puts the proxy in its own process group, so killing it
+// leaves us alone, and runs it as PROXY_RUN_AS_UID/PROXY_RUN_AS_GID if set
+func proxySysProcAttr() (*syscall.SysProcAttr, error) {
+	attr := &syscall.SysProcAttr{Setpgid: true}
+
+	uidEnv, gidEnv := os.Getenv("PROXY_RUN_AS_UID"), os.Getenv("PROXY_RUN_AS_GID")
+	if len(uidEnv) == 0 && len(gidEnv) == 0 {
+		return attr, nil
+	}
+
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	if len(uidEnv) > 0 {
+		parsed, err := strconv.ParseUint(uidEnv, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid PROXY_RUN_AS_UID %q: %+v", uidEnv, err)
+		}
+		uid = uint32(parsed)
+	}
+	if len(gidEnv) > 0 {
+		parsed, err := strconv.ParseUint(gidEnv, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid PROXY_RUN_AS_GID %q: %+v", gidEnv, err)
+		}
+		gid = uint32(parsed)
+	}
+
+	// Only root can switch to another identity
+	changing := int(uid) != os.Getuid() || int(gid) != os.Getgid()
+	if changing && os.Geteuid() != 0 {
+		return nil, fmt.Errorf("Running the proxy as uid %d gid %d needs root, the migrator runs as uid %d gid %d", uid, gid, os.Geteuid(), os.Getegid())
+	}
+
+	if err := checkReadableAs(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"), uid, gid); err != nil {
+		return nil, err
+	}
+
+	attr.Credential = &syscall.Credential{Uid: uid, Gid: gid, NoSetGroups: !changing}
+	logf("Running the proxy as uid %d gid %d\n", uid, gid)
+	return attr, nil
+}
+
+// checkReadableAs makes sure uid/gid can read the credentials file, which
+// otherwise only shows up as a proxy that never gets ready. It goes by the
+// file's mode bits alone, the proxy runs without supplementary groups
+func checkReadableAs(path string, uid, gid uint32) error {
+	if len(path) == 0 || uid == 0 {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("Could not check GOOGLE_APPLICATION_CREDENTIALS %s: %+v", path, err)
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	mode := info.Mode().Perm()
+	var readable bool
+	switch {
+	case st.Uid == uid:
+		readable = mode&0400 != 0
+	case st.Gid == gid:
+		readable = mode&0040 != 0
+	default:
+		readable = mode&0004 != 0
+	}
+	if !readable {
+		return fmt.Errorf("The proxy runs as uid %d gid %d, which can't read GOOGLE_APPLICATION_CREDENTIALS %s (owner %d:%d, mode %s)", uid, gid, path, st.Uid, st.Gid, mode)
+	}
+	return nil
+}
+
+// killProcessGroup sends a sig 9 to the process group of pid, for when go
+// doesn't manage to kill the proxy by itself
+func killProcessGroup(pid int) {
+	if pgid, err := syscall.Getpgid(pid); err == nil {
+		syscall.Kill(-pgid, 9)
+	}
+}
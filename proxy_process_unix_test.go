@@ -0,0 +1,74 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckReadableAs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sa.json")
+	if err := ioutil.WriteFile(path, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	owner, group := uint32(os.Getuid()), uint32(os.Getgid())
+	other := owner + 1000
+
+	for _, tc := range []struct {
+		mode     os.FileMode
+		uid, gid uint32
+		readable bool
+	}{
+		{0600, owner, group, true},
+		{0600, other, other, false},
+		{0640, other, group, true},
+		{0640, other, other, false},
+		{0644, other, other, true},
+		{0000, 0, 0, true},
+	} {
+		if err := os.Chmod(path, tc.mode); err != nil {
+			t.Fatal(err)
+		}
+		err := checkReadableAs(path, tc.uid, tc.gid)
+		if (err == nil) != tc.readable {
+			t.Errorf("checkReadableAs(mode %s, uid %d, gid %d) = %v, want readable %v", tc.mode, tc.uid, tc.gid, err, tc.readable)
+		}
+	}
+}
+
+func TestStartProxyTracksUntilKilled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cloud_sql_proxy")
+	script := "#!/bin/sh\necho 'Ready for new connections'\nsleep 60\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, done, err := startProxy(path, "proj:region:shadow", ShadowProxyPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runningProxiesMu.Lock()
+	_, tracked := runningProxies[cmd]
+	runningProxiesMu.Unlock()
+	if !tracked {
+		t.Errorf("a started proxy should be tracked for the signal trap")
+	}
+
+	killProxy(cmd, done)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the proxy didn't exit after killProxy")
+	}
+	runningProxiesMu.Lock()
+	_, tracked = runningProxies[cmd]
+	runningProxiesMu.Unlock()
+	if tracked {
+		t.Errorf("a killed proxy should no longer be tracked")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProxyEnv(t *testing.T) {
+	t.Setenv("DB_PASS", "secret")
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "/secrets/sa.json")
+	t.Setenv("CSQL_PROXY_MAX_CONNECTIONS", "10")
+	t.Setenv("PROXY_RUN_AS_GID", "")
+
+	has := func(env []string, name string) bool {
+		for _, kv := range env {
+			if strings.HasPrefix(kv, name+"=") {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Setenv("PROXY_RUN_AS_UID", "")
+	if env := proxyEnv(); !has(env, "DB_PASS") {
+		t.Errorf("proxyEnv under our own identity should pass the whole environment")
+	}
+
+	t.Setenv("PROXY_RUN_AS_UID", "65534")
+	env := proxyEnv()
+	for _, name := range []string{"GOOGLE_APPLICATION_CREDENTIALS", "CSQL_PROXY_MAX_CONNECTIONS"} {
+		if !has(env, name) {
+			t.Errorf("proxyEnv as another uid dropped %s", name)
+		}
+	}
+	for _, name := range []string{"DB_PASS", "PROXY_RUN_AS_UID"} {
+		if has(env, name) {
+			t.Errorf("proxyEnv as another uid passed on %s", name)
+		}
+	}
+}
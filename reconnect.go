@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rubenv/sql-migrate"
+)
+
+// DefaultReconnectRetries is how often a dropped connection is pinged again between migrations, see RECONNECT_RETRIES
+const DefaultReconnectRetries = 3
+
+// How often a dropped connection is pinged again between migrations, 0 to fail at once
+var reconnectRetries = DefaultReconnectRetries
+
+// ensureConnection pings the database before a migration, retrying while a
+// proxy reconnect is in progress. The pool dials new connections by itself, and
+// the tool keeps no session state like search_path or role on them, so a
+// working ping is all a reconnect needs. The advisory lock is the exception,
+// it lives on its own session and is checked separately, when one is held
+func ensureConnection(db *sql.DB, lock *migrationLock) error {
+	err := pingDB(db)
+	for attempt := 1; err != nil && attempt <= reconnectRetries; attempt++ {
+		logf("Lost the database connection (%+v), reconnecting in %s (%d/%d)\n", err, RetryDelay, attempt, reconnectRetries)
+		time.Sleep(RetryDelay)
+		err = pingDB(db)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not reconnect to the database between migrations: %w", err)
+	}
+	if lock != nil {
+		return lock.ensureHeld(db)
+	}
+	return nil
+}
+
+// isConnectionError tells a dropped connection from an error of the migration itself
+func isConnectionError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Class 08 is connection exception, 57P01 is admin_shutdown
+		return pqErr.Code.Class() == "08" || pqErr.Code == "57P01"
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// outsideTransactionError is the failure of a migration that runs outside a
+// transaction, some of its statements may have been applied already
+type outsideTransactionError struct {
+	err error
+}
+
+func (e *outsideTransactionError) Error() string { return e.err.Error() }
+func (e *outsideTransactionError) Unwrap() error { return e.err }
+
+// isRetryableApplyError reports whether an applyMigrations failure is worth
+// running the remaining plan again: a dropped connection, and never a
+// migration outside a transaction, which could apply its statements twice
+func isRetryableApplyError(err error) bool {
+	var partial *outsideTransactionError
+	return isConnectionError(err) && !errors.As(err, &partial)
+}
+
+// retryMigration applies a migration again after its connection dropped. Only
+// migrations in a transaction are retried, the server rolled those back, and
+// only when the tracking table shows the commit didn't make it before the drop
+func retryMigration(db *sql.DB, source *extensionMigrationSource, m *migrate.PlannedMigration, dir migrate.MigrationDirection, lock *migrationLock, err error) error {
+	if reconnectRetries == 0 || !isConnectionError(err) {
+		return err
+	}
+	if m.DisableTransaction {
+		logf("Not retrying %s after the dropped connection, it runs outside a transaction and may be partly applied\n", m.Id)
+		return err
+	}
+
+	logf("Lost the database connection during %s, reconnecting to retry it\n", m.Id)
+	if err := ensureConnection(db, lock); err != nil {
+		return err
+	}
+	applied, err := appliedMigrationIDs(db)
+	if err != nil {
+		return err
+	}
+	if applied[m.Id] == (dir == migrate.Up) {
+		logf("Migration %s was committed before the connection dropped, not retrying it\n", m.Id)
+		return nil
+	}
+	return applyMigration(db, source, m, dir)
+}
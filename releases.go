@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DefaultReleasesTable holds which release applied which migration
+const DefaultReleasesTable = "migration_releases"
+
+// releasesTable returns the configured release metadata table, quoted
+func releasesTable() string {
+	table := DefaultReleasesTable
+	if name := os.Getenv("MIGRATION_RELEASES_TABLE"); len(name) > 0 {
+		table = name
+	}
+	return pq.QuoteIdentifier(table)
+}
+
+// ensureReleasesTable creates the release metadata table if needed
+func ensureReleasesTable(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS " + releasesTable() + ` (
+		migration_id text NOT NULL,
+		release_version text NOT NULL,
+		operator text NOT NULL,
+		deploy_id text NOT NULL,
+		applied_at timestamptz NOT NULL
+	)`)
+	return err
+}
+
+// recordRelease stamps the migrations applied by this run with the release
+func recordRelease(db *sql.DB, release, operator, deployID string, ids []string) error {
+	if len(release) == 0 || len(ids) == 0 {
+		return nil
+	}
+	if err := ensureReleasesTable(db); err != nil {
+		return fmt.Errorf("Could not create release table: %+v", err)
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		_, err := db.Exec("INSERT INTO "+releasesTable()+" (migration_id, release_version, operator, deploy_id, applied_at) VALUES ($1, $2, $3, $4, $5)",
+			id, release, operator, deployID, now)
+		if err != nil {
+			return fmt.Errorf("Could not record release of %s: %+v", id, err)
+		}
+	}
+	logf("Recorded %d migrations for release %s\n", len(ids), release)
+	return nil
+}
+
+// printMigrationsForRelease lists the migrations applied under a release
+func printMigrationsForRelease(db *sql.DB, release string) error {
+	if err := ensureReleasesTable(db); err != nil {
+		return err
+	}
+	rows, err := db.Query("SELECT migration_id, operator, deploy_id, applied_at FROM "+releasesTable()+" WHERE release_version = $1 ORDER BY applied_at, migration_id", release)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var id, operator, deployID string
+		var appliedAt time.Time
+		if err := rows.Scan(&id, &operator, &deployID, &appliedAt); err != nil {
+			return err
+		}
+		outputf("%s %s (operator %s, deploy %s)\n", appliedAt.Format(time.RFC3339), id, operator, deployID)
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	logf("%d migrations applied under release %s\n", count, release)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// retryBudget is a single allowance of retries and time shared by every phase
+// of a run, so a flaky environment can't retry each phase independently forever
+type retryBudget struct {
+	remaining int
+	deadline  time.Time
+}
+
+// newRetryBudget parses RUN_RETRY_BUDGET and RUN_RETRY_WINDOW. Without a
+// budget no phase is retried, and without a window retries aren't time bound
+func newRetryBudget(count, window string) (*retryBudget, error) {
+	budget := &retryBudget{}
+	if len(count) > 0 {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid RUN_RETRY_BUDGET %q, expected a number of retries", count)
+		}
+		budget.remaining = n
+	}
+	if len(window) > 0 {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid RUN_RETRY_WINDOW %q: %+v", window, err)
+		}
+		budget.deadline = time.Now().Add(d)
+	}
+	return budget, nil
+}
+
+// run calls fn until it succeeds or the budget is spent
+func (b *retryBudget) run(phase string, fn func() error) error {
+	return b.runRetryable(phase, func(error) bool { return true }, fn)
+}
+
+// runRetryable is run for phases where only some failures are worth another
+// try, retryable tells those apart and the others are returned at once
+func (b *retryBudget) runRetryable(phase string, retryable func(error) bool, fn func() error) error {
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if b.remaining <= 0 || !retryable(err) {
+			return err
+		}
+		if !b.deadline.IsZero() && time.Now().Add(RetryDelay).After(b.deadline) {
+			return fmt.Errorf("%s failed and the retry window is over: %+v", phase, err)
+		}
+
+		b.remaining--
+		left := fmt.Sprintf("%d retries left", b.remaining)
+		if !b.deadline.IsZero() {
+			left = fmt.Sprintf("%s, %s left in the window", left, time.Until(b.deadline).Round(time.Second))
+		}
+		logf("%s failed with error: %+v. Retrying, %s\n", phase, err, left)
+		time.Sleep(RetryDelay)
+	}
+}
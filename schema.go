@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+
+	"github.com/rubenv/sql-migrate"
+)
+
+// dumpSchema writes the schema-only pg_dump of the database to path
+func dumpSchema(path, dbUser, dbPass, dbName string) error {
+	binary, err := findBinary(PGDumpBinary)
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"--schema-only",
+		"--host=localhost",
+		"--port=" + strconv.Itoa(SQLCloudProxyPort),
+		"--username=" + dbUser,
+		"--file=" + path,
+		dbName,
+	}
+	errBuff := new(bytes.Buffer)
+	cmd := exec.Command(binary, args...)
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+dbPass)
+	cmd.Stderr = errBuff
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_dump failed with error: %+v: %s", err, errBuff.String())
+	}
+
+	logln("Wrote schema dump to: ", path)
+	return nil
+}
+
+// schemaQueries describe the parts of the schema compared by SCHEMA_DIFF. Each
+// returns a key naming an object and a description that changes with it
+var schemaQueries = []struct {
+	kind  string
+	query string
+}{
+	{"table", `SELECT table_schema || '.' || table_name, table_type
+		FROM information_schema.tables
+		WHERE table_schema NOT IN ('pg_catalog', 'information_schema')`},
+	{"column", `SELECT table_schema || '.' || table_name || '.' || column_name,
+			data_type || CASE WHEN is_nullable = 'NO' THEN ' NOT NULL' ELSE '' END || COALESCE(' DEFAULT ' || column_default, '')
+		FROM information_schema.columns
+		WHERE table_schema NOT IN ('pg_catalog', 'information_schema')`},
+	{"index", `SELECT schemaname || '.' || indexname, indexdef
+		FROM pg_indexes
+		WHERE schemaname NOT IN ('pg_catalog', 'information_schema')`},
+}
+
+// introspectSchema snapshots tables, columns and indexes keyed by kind and name
+func introspectSchema(tx *sql.Tx) (map[string]string, error) {
+	schema := map[string]string{}
+	for _, q := range schemaQueries {
+		rows, err := tx.Query(q.query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var name, desc string
+			if err := rows.Scan(&name, &desc); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			schema[q.kind+" "+name] = desc
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return schema, nil
+}
+
+// printSchemaDiff applies the pending migrations inside a transaction, prints
+// the tables, columns and indexes they add, remove or change, and rolls back
+func printSchemaDiff(db *sql.DB, source *extensionMigrationSource) error {
+	planned, _, err := migrate.PlanMigration(db, "postgres", source, migrate.Up, 0)
+	if err != nil {
+		return err
+	}
+	if len(planned) == 0 {
+		logln("No pending migrations, the schema would not change")
+		return nil
+	}
+	for _, m := range planned {
+		if m.DisableTransaction {
+			return fmt.Errorf("Migration %s runs outside a transaction and can't be part of a schema diff", m.Id)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := introspectSchema(tx)
+	if err != nil {
+		return err
+	}
+	for _, m := range planned {
+		if err := execUpStatements(tx, source, m); err != nil {
+			return fmt.Errorf("Migration %s failed during the schema diff: %+v", m.Id, err)
+		}
+	}
+	after, err := introspectSchema(tx)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for name, desc := range after {
+		old, existed := before[name]
+		switch {
+		case !existed:
+			lines = append(lines, fmt.Sprintf("+ %s: %s", name, desc))
+		case old != desc:
+			lines = append(lines, fmt.Sprintf("~ %s: %s -> %s", name, old, desc))
+		}
+	}
+	for name, desc := range before {
+		if _, exists := after[name]; !exists {
+			lines = append(lines, fmt.Sprintf("- %s: %s", name, desc))
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i][2:] < lines[j][2:] })
+
+	logf("Schema diff of %d pending migrations (rolled back):\n", len(planned))
+	if len(lines) == 0 {
+		logln("No structural changes")
+	}
+	for _, line := range lines {
+		logln(line)
+	}
+	return nil
+}
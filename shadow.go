@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rubenv/sql-migrate"
+)
+
+// ShadowProxyPort is where the clone's proxy listens, next to the target's
+const ShadowProxyPort = SQLCloudProxyPort + 1
+
+// runShadowApply applies the pending migrations of source, skips included, to
+// instance, a fresh clone of the target, as a dress rehearsal before the real
+// run. The clone gets its own proxy, stopped again afterwards, and is reached
+// with the target's database name and credentials
+func runShadowApply(t *target, instance string, budget *retryBudget, source *extensionMigrationSource) error {
+	if instance == t.instanceID {
+		return fmt.Errorf("SHADOW_CLONE_INSTANCE is the target instance %s, it should name a clone", instance)
+	}
+
+	logln("Shadow applying the pending migrations to clone instance: ", instance)
+	shadow := &target{
+		proxyPath:  t.proxyPath,
+		instanceID: instance,
+		port:       ShadowProxyPort,
+		dbName:     t.dbName,
+		dbUser:     t.dbUser,
+		dbPass:     t.dbPass,
+		pgURL:      proxyDSN(t.dbUser, t.dbPass, t.dbName, ShadowProxyPort),
+	}
+	if err := shadow.startProxy(budget); err != nil {
+		return fmt.Errorf("Could not start the proxy for SHADOW_CLONE_INSTANCE %s: %+v", instance, err)
+	}
+	defer shadow.stopProxy()
+	db, err := shadow.openDB(budget)
+	if err != nil {
+		return fmt.Errorf("Could not connect to SHADOW_CLONE_INSTANCE %s: %+v", instance, err)
+	}
+	defer db.Close()
+
+	// The clone has no lock or events of its own, and its timings aren't the target's
+	var timings []migrationTiming
+	start := time.Now()
+	n, err := applyMigrations(db, source, migrate.Up, 0, applyOptions{timings: &timings})
+	elapsed := time.Since(start)
+	for _, timing := range timings {
+		logf("Shadow applied %s in %s\n", timing.ID, timing.Duration)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Shadow apply on %s failed after %d migrations, not touching the real target: %+v", instance, n, err)
+	}
+	logf("Shadow applied %d migrations to %s in %s, continuing with the real target\n", n, instance, elapsed)
+	return nil
+}
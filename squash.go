@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rubenv/sql-migrate"
+)
+
+// DefaultSquashFile is where -squash writes the baseline unless -squash-file is set
+const DefaultSquashFile = "baseline.sql"
+
+// squashTarget finds the migration -upto names, by id or by version number,
+// and returns the migrations up to and including it
+func squashTarget(all []*migrate.Migration, upto string) ([]*migrate.Migration, error) {
+	version, versionErr := strconv.ParseInt(upto, 10, 64)
+	for i, m := range all {
+		if m.Id == upto || (versionErr == nil && len(m.NumberPrefixMatches()) > 0 && m.VersionInt() == version) {
+			return all[:i+1], nil
+		}
+	}
+	return nil, fmt.Errorf("-upto %s names no migration, pass a migration id or version number", upto)
+}
+
+// runSquash writes a baseline SQL file for the migrations up to and including
+// upto: the schema-only dump of the reference database plus tracking records,
+// so a new environment applies it in one shot and continues after upto. The
+// reference database is only read
+func runSquash(upto, path string) {
+	if len(upto) == 0 {
+		pError(fmt.Errorf("-squash needs -upto, the last migration to fold into the baseline"))
+	}
+
+	migrations, err := migrationSource()
+	pError(err)
+	all, err := migrations.FindMigrations()
+	pError(err)
+	squashed, err := squashTarget(all, upto)
+	pError(err)
+
+	db, t := openTargetDB()
+	defer ensureProcessKill(proxyCMD)
+
+	// The dump only represents the baseline when exactly those migrations are applied
+	applied, err := appliedMigrationIDs(db)
+	pError(err)
+	var missing, beyond []string
+	for i, m := range all {
+		if i < len(squashed) && !applied[m.Id] {
+			missing = append(missing, m.Id)
+		} else if i >= len(squashed) && applied[m.Id] {
+			beyond = append(beyond, m.Id)
+		}
+	}
+	if len(missing) > 0 {
+		pError(fmt.Errorf("The reference database doesn't have these migrations applied: %s", strings.Join(missing, ", ")))
+	}
+	if len(beyond) > 0 {
+		pError(fmt.Errorf("The reference database has migrations after %s applied, its schema is past the baseline: %s", squashed[len(squashed)-1].Id, strings.Join(beyond, ", ")))
+	}
+
+	dumpFile, err := ioutil.TempFile("", "migrator-squash-*.sql")
+	pError(err)
+	dumpFile.Close()
+	defer os.Remove(dumpFile.Name())
+	pError(dumpSchema(dumpFile.Name(), t.dbUser, t.dbPass, t.dbName))
+	dump, err := ioutil.ReadFile(dumpFile.Name())
+	pError(err)
+
+	// pg_dump empties search_path, so the seeding needs the table's actual schema
+	var schema string
+	err = db.QueryRow("SELECT n.nspname FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.oid = to_regclass($1)", trackingTableName()).Scan(&schema)
+	if err != nil {
+		pError(fmt.Errorf("Could not find the schema of tracking table %s: %+v", trackingTableLabel(), err))
+	}
+	table := pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(trackingTable)
+
+	last := squashed[len(squashed)-1].Id
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "-- Baseline of %d migrations up to and including %s\n", len(squashed), last)
+	fmt.Fprintf(&b, "-- Generated by migrator %s from database %s at %s\n", version, t.dbName, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "-- Apply it to an empty database, then run the migrator to continue after %s\n\n", last)
+	b.Write(dump)
+	fmt.Fprintf(&b, "\n-- Seed the tracking table so the migrator skips the squashed migrations\n")
+	fmt.Fprintf(&b, "CREATE TABLE IF NOT EXISTS %s (id varchar(255) NOT NULL PRIMARY KEY, applied_at timestamp with time zone);\n", table)
+	for _, m := range squashed {
+		fmt.Fprintf(&b, "INSERT INTO %s (id, applied_at) VALUES (%s, now()) ON CONFLICT (id) DO NOTHING;\n", table, pq.QuoteLiteral(m.Id))
+	}
+
+	pError(ioutil.WriteFile(path, b.Bytes(), 0644))
+	logf("Wrote baseline of %d migrations up to %s to: %s\n", len(squashed), last, path)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rubenv/sql-migrate"
+)
+
+// migrateCommandPrefix starts the sql-migrate annotations in a migration file
+const migrateCommandPrefix = "-- +migrate "
+
+// scanStreamedMigration builds a placeholder for a migration that is too big to
+// load. It only reads the annotations, the statements are streamed when applied
+func scanStreamedMigration(id, path string) (*migrate.Migration, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening %s: %+v", id, err)
+	}
+	defer file.Close()
+
+	m := &migrate.Migration{Id: id}
+	err = readLines(file, func(line string) (bool, error) {
+		fields := migrateCommand(line)
+		if len(fields) > 1 && fields[1] == "notransaction" {
+			switch fields[0] {
+			case "Up":
+				m.DisableTransactionUp = true
+			case "Down":
+				m.DisableTransactionDown = true
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing %s: %+v", id, err)
+	}
+	return m, nil
+}
+
+// execUpStatements runs the Up statements of a planned migration on executor,
+// streamed from disk when the file is over the size cap, so the checks before
+// an apply see the same statements the apply runs
+func execUpStatements(executor sqlExecutor, source *extensionMigrationSource, m *migrate.PlannedMigration) error {
+	streamed, err := source.overSizeCap(m.Id)
+	if err != nil {
+		return err
+	}
+	if streamed {
+		return streamMigration(executor, filepath.Join(source.Dir, m.Id), migrate.Up)
+	}
+	for _, stmt := range m.Queries {
+		if _, err := executor.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamMigration executes the statements of one direction of a migration file
+// as they are read, following sql-migrate's parsing rules, so only a single
+// statement is held in memory at a time
+func streamMigration(executor sqlExecutor, path string, dir migrate.MigrationDirection) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	want := "Up"
+	if dir == migrate.Down {
+		want = "Down"
+	}
+
+	var buf strings.Builder
+	inSection, seenSection, ignoreSemicolons := false, false, false
+	execute := func() error {
+		stmt := buf.String()
+		buf.Reset()
+		if len(strings.TrimSpace(stmt)) == 0 {
+			return nil
+		}
+		_, err := executor.Exec(trimStatement(stmt))
+		return err
+	}
+
+	err = readLines(file, func(line string) (bool, error) {
+		// Plain comments are dropped, like sql-migrate does
+		if strings.HasPrefix(line, "-- ") && !strings.HasPrefix(line, "-- +") {
+			return true, nil
+		}
+
+		if fields := migrateCommand(line); len(fields) > 0 {
+			switch fields[0] {
+			case "Up", "Down":
+				if seenSection {
+					// Our direction is done, no need to read the rest
+					return false, nil
+				}
+				inSection = fields[0] == want
+				seenSection = inSection
+			case "StatementBegin":
+				ignoreSemicolons = inSection
+			case "StatementEnd":
+				if ignoreSemicolons {
+					ignoreSemicolons = false
+					return true, execute()
+				}
+			}
+			return true, nil
+		}
+
+		if !inSection {
+			return true, nil
+		}
+		buf.WriteString(line + "\n")
+		if !ignoreSemicolons && endsWithSemicolon(line) {
+			return true, execute()
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if ignoreSemicolons {
+		return fmt.Errorf("Saw '-- +migrate StatementBegin' with no matching '-- +migrate StatementEnd'")
+	}
+	if len(strings.TrimSpace(buf.String())) > 0 {
+		return fmt.Errorf("The last statement must be ended by a semicolon or '-- +migrate StatementEnd' marker")
+	}
+	return nil
+}
+
+// readLines calls fn for every line of r, without a line length limit, until
+// fn returns false or an error
+func readLines(r io.Reader, fn func(line string) (bool, error)) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) > 0 {
+			more, fnErr := fn(strings.TrimRight(line, "\r\n"))
+			if fnErr != nil || !more {
+				return fnErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// migrateCommand returns the fields of a sql-migrate annotation line, or nil
+func migrateCommand(line string) []string {
+	if !strings.HasPrefix(line, migrateCommandPrefix) {
+		return nil
+	}
+	return strings.Fields(line[len(migrateCommandPrefix):])
+}
+
+// endsWithSemicolon reports whether the line ends a statement, ignoring a
+// trailing -- comment, the same check sql-migrate's parser uses
+func endsWithSemicolon(line string) bool {
+	prev := ""
+	for _, word := range strings.Fields(line) {
+		if strings.HasPrefix(word, "--") {
+			break
+		}
+		prev = word
+	}
+	return strings.HasSuffix(prev, ";")
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// The schema diff runs migrations through execUpStatements, streamed ones included
+func TestExecUpStatementsStreamsLargeFiles(t *testing.T) {
+	content := "-- +migrate Up\nCREATE TABLE a (id int);\nCREATE INDEX a_id ON a (id);\n-- +migrate Down\nDROP TABLE a;\n"
+	for _, maxBytes := range []int64{0, 16} {
+		source := testSource(t, maxBytes, map[string]string{"1_a.sql": content})
+		collector := &collectingExecutor{}
+		if err := execUpStatements(collector, source, plannedUp(t, source)[0]); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(collector.statements))
+		for i, stmt := range collector.statements {
+			got[i] = strings.TrimRight(strings.TrimSpace(stmt), ";")
+		}
+		want := []string{"CREATE TABLE a (id int)", "CREATE INDEX a_id ON a (id)"}
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("MaxFileBytes %d: statements %q, want %q", maxBytes, got, want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strings"
+	"text/template"
+)
+
+// runSummary is the machine readable outcome of a run
+type runSummary struct {
+	Operator string `json:"operator"`
+	DeployID string `json:"deploy_id"`
+	Release  string `json:"release_version,omitempty"`
+
+	// The environment the run executed against
+	ProxyVersion  string `json:"proxy_version"`
+	ServerVersion string `json:"server_version"`
+	ToolVersion   string `json:"tool_version"`
+
+	Applied    int      `json:"applied"`
+	AppliedIDs []string `json:"applied_ids"`
+	SkippedIDs []string `json:"skipped_ids"`
+
+	// Pending migrations deliberately left out through SKIP_MIGRATIONS
+	ExcludedIDs []string `json:"excluded_ids,omitempty"`
+}
+
+// write stores the summary as JSON at path, if one is configured
+func (s *runSummary) write(path string) error {
+	if len(path) == 0 {
+		return nil
+	}
+
+	bytez, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, bytez, 0644)
+}
+
+// parseNoChangeMessage parses NOCHANGE_MESSAGE, a text/template over the run
+// summary like "Nothing to apply for {{.DeployID}}". It's tried out on an
+// empty summary, so a typo fails before the run and not at its end
+func parseNoChangeMessage(text string) (*template.Template, error) {
+	tmpl, err := template.New("NOCHANGE_MESSAGE").Parse(text)
+	if err == nil {
+		err = tmpl.Execute(ioutil.Discard, &runSummary{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid NOCHANGE_MESSAGE %q: %+v", text, err)
+	}
+	return tmpl, nil
+}
+
+// message renders the NOCHANGE_MESSAGE template for the summary
+func (s *runSummary) message(tmpl *template.Template) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, s); err != nil {
+		return "", fmt.Errorf("Could not render NOCHANGE_MESSAGE: %+v", err)
+	}
+	return b.String(), nil
+}
+
+// defaultOperator names the OS user. Arbitrary-uid pods often have no passwd
+// entry for their uid, so it falls back to $USER, the uid and then "unknown"
+// rather than fail, the operator is only a label
+func defaultOperator() string {
+	u, err := user.Current()
+	if err == nil && len(u.Username) > 0 {
+		return u.Username
+	}
+	if err == nil {
+		err = fmt.Errorf("user %s has no name", u.Uid)
+	}
+	operator := os.Getenv("USER")
+	if len(operator) == 0 {
+		if uid := os.Getuid(); uid >= 0 {
+			operator = fmt.Sprintf("uid:%d", uid)
+		} else {
+			operator = "unknown"
+		}
+	}
+	logf("Warning, could not look up the OS user (%+v), defaulting OPERATOR to %q\n", err, operator)
+	return operator
+}
+
+// runIdentity fills in the operator and deploy id of a run, defaulting to the
+// OS user and a fresh random UUID
+func runIdentity(operator, deployID string) (string, string, error) {
+	if len(operator) == 0 {
+		operator = defaultOperator()
+	}
+
+	if len(deployID) == 0 {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", "", err
+		}
+		// Version 4, RFC 4122 variant
+		b[6] = (b[6] & 0x0f) | 0x40
+		b[8] = (b[8] & 0x3f) | 0x80
+		deployID = fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	}
+	return operator, deployID, nil
+}
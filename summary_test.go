@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestNoChangeMessage(t *testing.T) {
+	summary := &runSummary{Operator: "ops", DeployID: "d-42", Release: "v1.2", SkippedIDs: []string{"1_init.sql", "2_users.sql"}}
+	for _, tc := range []struct {
+		text, want string
+	}{
+		{NoChangeMessage, "Applied 0 migrations!"},
+		{"Nothing to apply for {{.DeployID}} by {{.Operator}}", "Nothing to apply for d-42 by ops"},
+		{"{{.Release}}: {{len .SkippedIDs}} already applied", "v1.2: 2 already applied"},
+	} {
+		tmpl, err := parseNoChangeMessage(tc.text)
+		if err != nil {
+			t.Errorf("parseNoChangeMessage(%q) failed: %v", tc.text, err)
+			continue
+		}
+		if got, err := summary.message(tmpl); err != nil || got != tc.want {
+			t.Errorf("NOCHANGE_MESSAGE %q = %q, %v, want %q", tc.text, got, err, tc.want)
+		}
+	}
+
+	for _, text := range []string{"{{.DeployID", "{{.NoSuchField}}"} {
+		if _, err := parseNoChangeMessage(text); err == nil {
+			t.Errorf("parseNoChangeMessage(%q) succeeded, want an error", text)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// migrationTiming is how long one migration took to apply
+type migrationTiming struct {
+	ID        string
+	Duration  time.Duration
+	AppliedAt time.Time
+}
+
+// Timings of the migrations applied up during this run, in order
+var appliedTimings []migrationTiming
+
+// timingRecord is one row of the timing history
+type timingRecord struct {
+	ID          string    `json:"id"`
+	Environment string    `json:"environment"`
+	DurationMS  int64     `json:"duration_ms"`
+	AppliedAt   time.Time `json:"applied_at"`
+}
+
+// recordTimings appends the run's migration timings to the history table
+// and/or the JSON lines file, whichever are configured
+func recordTimings(db *sql.DB, table, file, environment string) error {
+	if len(appliedTimings) == 0 || (len(table) == 0 && len(file) == 0) {
+		return nil
+	}
+
+	records := make([]timingRecord, 0, len(appliedTimings))
+	for _, t := range appliedTimings {
+		records = append(records, timingRecord{
+			ID:          t.ID,
+			Environment: environment,
+			DurationMS:  t.Duration.Milliseconds(),
+			AppliedAt:   t.AppliedAt,
+		})
+	}
+
+	if len(table) > 0 {
+		quoted := pq.QuoteIdentifier(table)
+		_, err := db.Exec("CREATE TABLE IF NOT EXISTS " + quoted + ` (
+			id text NOT NULL,
+			environment text NOT NULL,
+			duration_ms bigint NOT NULL,
+			applied_at timestamptz NOT NULL
+		)`)
+		if err != nil {
+			return fmt.Errorf("Could not create timings table %s: %+v", table, err)
+		}
+		for _, r := range records {
+			_, err := db.Exec("INSERT INTO "+quoted+" (id, environment, duration_ms, applied_at) VALUES ($1, $2, $3, $4)",
+				r.ID, r.Environment, r.DurationMS, r.AppliedAt)
+			if err != nil {
+				return fmt.Errorf("Could not record timing of %s: %+v", r.ID, err)
+			}
+		}
+	}
+
+	if len(file) > 0 {
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		encoder := json.NewEncoder(f)
+		for _, r := range records {
+			if err := encoder.Encode(r); err != nil {
+				return err
+			}
+		}
+	}
+
+	logf("Recorded timings of %d migrations\n", len(records))
+	return nil
+}